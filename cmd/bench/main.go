@@ -0,0 +1,198 @@
+// Command bench runs a plugin against many in-memory streams and writes a
+// JSON report of its throughput and latency to stdout.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wcraigjones/wazero-stream-demo/host"
+)
+
+//go:embed plugin.wasm
+var plugin []byte
+
+func main() {
+	pluginPath := flag.String("plugin", "", "plugin wasm file (default: the embedded plugin)")
+	cacheDir := flag.String("cache", "", "compilation cache directory")
+	engineName := flag.String("engine", "compiler", "wazero engine: compiler or interpreter")
+	transportName := flag.String("transport", "file", "stream transport: file or host")
+	workers := flag.Int("workers", 25, "concurrent plugin calls")
+	streams := flag.Int("streams", 100000, "number of streams")
+	payloadSpec := flag.String("payload", "fixed:4096", "payload sizes: fixed:N, uniform:MIN:MAX or exp:MEAN")
+	pipeCapacity := flag.Int("pipe-capacity", host.DefaultPipeCapacity, "bytes buffered per output stream")
+	seed := flag.Int64("seed", 1, "random seed for payloads")
+	flag.Parse()
+	log.SetFlags(0)
+
+	rep := report{
+		Plugin:       "embedded",
+		Engine:       *engineName,
+		Transport:    *transportName,
+		Workers:      *workers,
+		Streams:      *streams,
+		Payload:      *payloadSpec,
+		PipeCapacity: *pipeCapacity,
+	}
+
+	var config host.EngineConfig
+	switch *transportName {
+	case "file":
+		config.Transport = host.TransportFile
+	case "host":
+		config.Transport = host.TransportHost
+	default:
+		log.Fatalf("unknown transport %q", *transportName)
+	}
+	switch *engineName {
+	case "compiler":
+	case "interpreter":
+		config.Interpreter = true
+	default:
+		log.Fatalf("unknown engine %q", *engineName)
+	}
+	if *workers <= 0 {
+		log.Fatal("workers must be positive")
+	}
+	dist, err := parsePayloadDist(*payloadSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wasm := plugin
+	if *pluginPath != "" {
+		if wasm, err = os.ReadFile(*pluginPath); err != nil {
+			log.Fatal(err)
+		}
+		rep.Plugin = *pluginPath
+	}
+	sum := sha256.Sum256(wasm)
+	rep.PluginVersion = hex.EncodeToString(sum[:6])
+
+	if *cacheDir != "" {
+		if config.Cache, err = host.NewCompilationCache(*cacheDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	log.Println("registering streams")
+	pluginFS := host.NewPluginFS()
+	ids := make([]string, *streams)
+	seeds := make([][]byte, *streams)
+	readers := make([]*host.PipeReader, *streams)
+	rnd := rand.New(rand.NewSource(*seed))
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%x", rnd.Int63())
+		seeds[i] = make([]byte, dist.size(rnd))
+		rnd.Read(seeds[i])
+
+		var w *host.PipeWriter
+		readers[i], w = host.NewPipe(*pipeCapacity)
+		if err := pluginFS.Register(ids[i], host.NewInFile(bytes.NewReader(seeds[i])), host.NewOutFile(w)); err != nil {
+			log.Fatal(err)
+		}
+		rep.Bytes += int64(len(seeds[i]))
+	}
+
+	compileStart := time.Now()
+	engine, err := host.NewEngineWithConfig(ctx, wasm, pluginFS, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rep.Compile = time.Since(compileStart).Seconds()
+	if config.Cache != nil {
+		stats := config.Cache.Stats()
+		rep.Cache = &cacheInfo{Hits: stats.Hits, Misses: stats.Misses}
+	}
+	defer engine.Close(ctx)
+
+	pool, err := host.NewPool(ctx, engine, host.PoolConfig{
+		MinSize: *workers,
+		MaxSize: *workers,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close(ctx)
+
+	log.Println("running")
+	var errCount, mismatches int64
+	latencies := make([]time.Duration, len(ids))
+	start := time.Now()
+
+	readWG := sync.WaitGroup{}
+	for i := range ids {
+		readWG.Add(1)
+		go func(i int) {
+			defer readWG.Done()
+			data, err := io.ReadAll(readers[i])
+			if err == nil && !bytes.Equal(seeds[i], data) {
+				atomic.AddInt64(&mismatches, 1)
+			}
+		}(i)
+	}
+
+	dispatcher := host.NewDispatcher(pool, host.DispatcherConfig{Workers: *workers})
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+	go func() {
+		for range progress.C {
+			stats := dispatcher.Stats()
+			log.Printf("queued %d running %d done %d", stats.Queued, stats.Running, stats.Done)
+		}
+	}()
+
+	waits := make([]time.Duration, len(ids))
+	for i := range ids {
+		i := i
+		err := dispatcher.Submit(ctx, ids[i], func(r host.Result) {
+			latencies[i], waits[i] = r.Run, r.Wait
+			if r.Err != nil {
+				atomic.AddInt64(&errCount, 1)
+				log.Printf("stream %s: %v", r.ID, r.Err)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	dispatcher.Close()
+	readWG.Wait()
+	elapsed := time.Since(start)
+
+	rep.Elapsed = elapsed.Seconds()
+	rep.Errors = int(errCount)
+	rep.Mismatches = int(mismatches)
+	rep.StreamsPerSecond = float64(len(ids)) / elapsed.Seconds()
+	rep.BytesPerSecond = float64(rep.Bytes) / elapsed.Seconds()
+	rep.Latency = summarize(latencies)
+	rep.QueueWait = summarize(waits)
+	for _, r := range readers {
+		stats := r.Stats()
+		rep.WriterBlocked += stats.WriterBlocked.Seconds()
+		rep.ReaderBlocked += stats.ReaderBlocked.Seconds()
+	}
+	if n := pluginFS.Len(); n != 0 {
+		log.Printf("%d streams left registered", n)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// payloadDist is the distribution of payload sizes, parsed from -payload.
+type payloadDist struct {
+	spec string
+	kind string
+	a, b int
+}
+
+// parsePayloadDist parses fixed:N, uniform:MIN:MAX or exp:MEAN.
+func parsePayloadDist(spec string) (payloadDist, error) {
+	d := payloadDist{spec: spec}
+	parts := strings.Split(spec, ":")
+	d.kind = parts[0]
+	nums := make([]int, len(parts)-1)
+	for i, p := range parts[1:] {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return d, fmt.Errorf("payload %q: bad size %q", spec, p)
+		}
+		nums[i] = n
+	}
+
+	switch {
+	case d.kind == "fixed" && len(nums) == 1, d.kind == "exp" && len(nums) == 1:
+		d.a = nums[0]
+	case d.kind == "uniform" && len(nums) == 2 && nums[0] <= nums[1]:
+		d.a, d.b = nums[0], nums[1]
+	default:
+		return d, fmt.Errorf("payload %q: want fixed:N, uniform:MIN:MAX or exp:MEAN", spec)
+	}
+	return d, nil
+}
+
+// size returns a random payload size.
+func (d payloadDist) size(r *rand.Rand) int {
+	switch d.kind {
+	case "uniform":
+		return d.a + r.Intn(d.b-d.a+1)
+	case "exp":
+		return int(math.Round(r.ExpFloat64() * float64(d.a)))
+	default:
+		return d.a
+	}
+}
+
+func (d payloadDist) String() string { return d.spec }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// report is the JSON written when a run finishes. Durations are in
+// seconds.
+type report struct {
+	Plugin        string     `json:"plugin"`
+	PluginVersion string     `json:"plugin_version"`
+	Engine        string     `json:"engine"`
+	Transport     string     `json:"transport"`
+	Workers       int        `json:"workers"`
+	Streams       int        `json:"streams"`
+	Payload       string     `json:"payload"`
+	PipeCapacity  int        `json:"pipe_capacity"`
+	Compile       float64    `json:"compile_seconds"`
+	Cache         *cacheInfo `json:"cache,omitempty"`
+
+	Elapsed          float64 `json:"elapsed_seconds"`
+	Errors           int     `json:"errors"`
+	Mismatches       int     `json:"mismatches"`
+	Bytes            int64   `json:"bytes"`
+	StreamsPerSecond float64 `json:"streams_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+	Latency          latency `json:"latency_seconds"`
+	QueueWait        latency `json:"queue_wait_seconds"`
+	WriterBlocked    float64 `json:"writer_blocked_seconds"`
+	ReaderBlocked    float64 `json:"reader_blocked_seconds"`
+}
+
+type cacheInfo struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// latency summarizes a duration measured for each stream: the time it spent
+// in Pool.Do, or queued for a worker.
+type latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+func summarize(d []time.Duration) latency {
+	if len(d) == 0 {
+		return latency{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	var total time.Duration
+	for _, v := range d {
+		total += v
+	}
+	return latency{
+		Min:  d[0].Seconds(),
+		Mean: (total / time.Duration(len(d))).Seconds(),
+		P50:  percentile(d, 50),
+		P90:  percentile(d, 90),
+		P99:  percentile(d, 99),
+		P999: percentile(d, 99.9),
+		Max:  d[len(d)-1].Seconds(),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of the sorted d.
+func percentile(d []time.Duration, p float64) float64 {
+	i := int(math.Ceil(float64(len(d))*p/100)) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(d) {
+		i = len(d) - 1
+	}
+	return d[i].Seconds()
+}
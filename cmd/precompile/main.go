@@ -0,0 +1,47 @@
+// Command precompile warms a plugin compilation cache so that hosts using the
+// same cache directory start without compiling.
+//
+//	precompile -cache DIR plugin.wasm...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/wcraigjones/wazero-stream-demo/host"
+)
+
+func main() {
+	cacheDir := flag.String("cache", "", "compilation cache directory")
+	flag.Parse()
+	if *cacheDir == "" || flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: precompile -cache DIR plugin.wasm...")
+		os.Exit(2)
+	}
+
+	cache, err := host.NewCompilationCache(*cacheDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range flag.Args() {
+		wasm, err := os.ReadFile(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hit, err := cache.Precompile(ctx, wasm)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		if hit {
+			fmt.Printf("%s: already cached\n", name)
+		} else {
+			fmt.Printf("%s: compiled\n", name)
+		}
+	}
+	stats := cache.Stats()
+	fmt.Printf("hits: %d misses: %d\n", stats.Hits, stats.Misses)
+}
@@ -1,8 +1,8 @@
-module wazero
+module github.com/wcraigjones/wazero-stream-demo
 
 go 1.19
 
 require (
 	github.com/psanford/memfs v0.0.0-20210214183328-a001468d78ef
-	github.com/tetratelabs/wazero v1.0.0-pre.2
+	github.com/tetratelabs/wazero v1.0.3
 )
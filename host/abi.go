@@ -0,0 +1,117 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// ABIVersion is the plugin ABI this host implements. A plugin declares the
+// version it was built for by exporting an empty function named
+// abi_version_<version>, so it can be checked without instantiating it.
+const ABIVersion = 3
+
+const abiVersionPrefix = "abi_version_"
+
+// ErrIncompatible is matched by an ABIError.
+var ErrIncompatible = errors.New("incompatible plugin")
+
+// signature is the parameter and result types of a function.
+type signature struct {
+	params  []api.ValueType
+	results []api.ValueType
+}
+
+func (s signature) String() string {
+	return "(" + valueTypeNames(s.params) + ") -> (" + valueTypeNames(s.results) + ")"
+}
+
+func (s signature) equal(params, results []api.ValueType) bool {
+	return string(s.params) == string(params) && string(s.results) == string(results)
+}
+
+func valueTypeNames(types []api.ValueType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = api.ValueTypeName(t)
+	}
+	return strings.Join(names, ", ")
+}
+
+// abiExports are the functions a plugin must export.
+var abiExports = []struct {
+	name string
+	sig  signature
+}{
+	{"my_malloc", signature{params: []api.ValueType{api.ValueTypeI32}, results: []api.ValueType{api.ValueTypeI32}}},
+	{"my_free", signature{params: []api.ValueType{api.ValueTypeI32}}},
+	{"do", signature{params: []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, results: []api.ValueType{api.ValueTypeI32}}},
+	{"error_message", signature{results: []api.ValueType{api.ValueTypeI64}}},
+}
+
+// ABIError reports why a plugin can't be run by this host.
+type ABIError struct {
+	// Version is the ABI version the plugin declares, or 0 if it declares
+	// none.
+	Version  int
+	Problems []string
+}
+
+func (e *ABIError) Error() string {
+	return "incompatible plugin: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ABIError) Is(target error) bool { return target == ErrIncompatible }
+
+// checkABI validates the exports of a compiled plugin against ABIVersion.
+func checkABI(code wazero.CompiledModule) error {
+	exports := code.ExportedFunctions()
+	abiErr := &ABIError{}
+
+	for name, def := range exports {
+		if !strings.HasPrefix(name, abiVersionPrefix) {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(name, abiVersionPrefix))
+		if err != nil || v <= 0 {
+			abiErr.Problems = append(abiErr.Problems, fmt.Sprintf("malformed ABI version export %q", name))
+			continue
+		}
+		if abiErr.Version != 0 {
+			abiErr.Problems = append(abiErr.Problems, "declares more than one ABI version")
+		}
+		abiErr.Version = v
+		if len(def.ParamTypes()) != 0 || len(def.ResultTypes()) != 0 {
+			abiErr.Problems = append(abiErr.Problems, fmt.Sprintf("export %s has signature %s, want ()", name,
+				signature{def.ParamTypes(), def.ResultTypes()}))
+		}
+	}
+	switch abiErr.Version {
+	case ABIVersion:
+	case 0:
+		abiErr.Problems = append(abiErr.Problems, fmt.Sprintf("declares no ABI version, want an export named %s%d",
+			abiVersionPrefix, ABIVersion))
+	default:
+		abiErr.Problems = append(abiErr.Problems, fmt.Sprintf("built for ABI version %d, host supports %d",
+			abiErr.Version, ABIVersion))
+	}
+
+	for _, want := range abiExports {
+		def, ok := exports[want.name]
+		if !ok {
+			abiErr.Problems = append(abiErr.Problems, fmt.Sprintf("missing export %s %s", want.name, want.sig))
+		} else if !want.sig.equal(def.ParamTypes(), def.ResultTypes()) {
+			abiErr.Problems = append(abiErr.Problems, fmt.Sprintf("export %s has signature %s, want %s",
+				want.name, signature{def.ParamTypes(), def.ResultTypes()}, want.sig))
+		}
+	}
+
+	if len(abiErr.Problems) > 0 {
+		return abiErr
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+func TestCheckABI(t *testing.T) {
+	version := func(v string, params ...api.ValueType) testFunc {
+		return testFunc{name: abiVersionPrefix + v, params: params}
+	}
+	current := strconv.Itoa(ABIVersion)
+	next := strconv.Itoa(ABIVersion + 1)
+	// plugin returns the exports of a compatible plugin, with those named
+	// in replace swapped for the given ones and those named in drop left
+	// out.
+	plugin := func(replace []testFunc, drop ...string) []testFunc {
+		var funcs []testFunc
+	next:
+		for _, f := range pluginFuncs(nil) {
+			for _, name := range drop {
+				if f.name == name {
+					continue next
+				}
+			}
+			for _, r := range replace {
+				if f.name == r.name {
+					f = r
+				}
+			}
+			funcs = append(funcs, f)
+		}
+		return funcs
+	}
+
+	for _, tc := range []struct {
+		name    string
+		funcs   []testFunc
+		version int
+		// problems are substrings of the problems reported, in order.
+		problems []string
+	}{
+		{name: "compatible", funcs: plugin(nil), version: ABIVersion},
+		{
+			name:     "missing version",
+			funcs:    plugin(nil, abiVersionPrefix+current),
+			problems: []string{"declares no ABI version, want an export named " + abiVersionPrefix + current},
+		},
+		{
+			name:     "wrong version",
+			funcs:    append(plugin(nil, abiVersionPrefix+current), version(next)),
+			version:  ABIVersion + 1,
+			problems: []string{"built for ABI version " + next + ", host supports " + current},
+		},
+		{
+			// Both name the current version, so that which is seen last
+			// doesn't matter.
+			name:     "two versions",
+			funcs:    append(plugin(nil), version("0"+current)),
+			version:  ABIVersion,
+			problems: []string{"declares more than one ABI version"},
+		},
+		{
+			name:     "malformed version",
+			funcs:    append(plugin(nil), version("v2")),
+			version:  ABIVersion,
+			problems: []string{`malformed ABI version export "` + abiVersionPrefix + `v2"`},
+		},
+		{
+			name:     "version with parameters",
+			funcs:    plugin([]testFunc{version(current, i32)}),
+			version:  ABIVersion,
+			problems: []string{"export " + abiVersionPrefix + current + " has signature (i32) -> (), want ()"},
+		},
+		{
+			name:     "wrong signature",
+			funcs:    plugin([]testFunc{{name: "my_free", params: []api.ValueType{i64}}}),
+			version:  ABIVersion,
+			problems: []string{"export my_free has signature (i64) -> (), want (i32) -> ()"},
+		},
+		{
+			name:     "missing export",
+			funcs:    plugin(nil, "error_message"),
+			version:  ABIVersion,
+			problems: []string{"missing export error_message () -> (i64)"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+			defer r.Close(ctx)
+			code, err := r.CompileModule(ctx, testModule(tc.funcs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = checkABI(code)
+			if tc.problems == nil {
+				if err != nil {
+					t.Fatalf("checkABI: %v, want nil", err)
+				}
+				return
+			}
+			var abiErr *ABIError
+			if !errors.As(err, &abiErr) || !errors.Is(err, ErrIncompatible) {
+				t.Fatalf("checkABI: %v, want an ABIError", err)
+			}
+			if tc.version != 0 && abiErr.Version != tc.version {
+				t.Errorf("Version %d, want %d", abiErr.Version, tc.version)
+			}
+			if len(abiErr.Problems) != len(tc.problems) {
+				t.Fatalf("problems %q, want %q", abiErr.Problems, tc.problems)
+			}
+			for i, want := range tc.problems {
+				if !strings.Contains(abiErr.Problems[i], want) {
+					t.Errorf("problem %q, want %q", abiErr.Problems[i], want)
+				}
+			}
+		})
+	}
+}
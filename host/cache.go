@@ -0,0 +1,137 @@
+package host
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// CompilationCache persists compiled plugins in a directory so that later
+// processes skip compiling the same wasm. Only the compiler engine uses it.
+// It is safe to share between engines, which also share the compiled code of
+// identical plugins in memory. That code is kept for the life of the
+// process.
+type CompilationCache struct {
+	dir   string
+	cache wazero.CompilationCache
+	// mu serializes compilation, as wazero doesn't support several runtimes
+	// writing to the same cache directory at once.
+	mu     sync.Mutex
+	hits   uint64
+	misses uint64
+}
+
+// CacheStats counts compilations served from a CompilationCache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// NewCompilationCache returns a cache stored in dir, creating it if needed.
+func NewCompilationCache(dir string) (*CompilationCache, error) {
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CompilationCache{dir: dir, cache: cache}, nil
+}
+
+// Dir returns the directory the cache is stored in.
+func (c *CompilationCache) Dir() string { return c.dir }
+
+// Stats returns the number of compilations that were and weren't served from
+// the cache.
+func (c *CompilationCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// Precompile compiles wasm into the cache without keeping it, and reports
+// whether it was already cached.
+func (c *CompilationCache) Precompile(ctx context.Context, wasm []byte) (hit bool, err error) {
+	r := c.newRuntime(ctx)
+	defer r.Close(ctx)
+	_, hit, err = c.compile(ctx, r, wasm)
+	return hit, err
+}
+
+func (c *CompilationCache) newRuntime(ctx context.Context) wazero.Runtime {
+	return wazero.NewRuntimeWithConfig(ctx, newRuntimeConfig(wazero.NewRuntimeConfigCompiler()).WithCompilationCache(c.cache))
+}
+
+// compile compiles wasm with r, which must have been created by newRuntime.
+//
+// wazero doesn't report cache hits, so they are detected from the entry it
+// keeps for wasm: a hit is an entry that existed before compiling and wasn't
+// rewritten by it.
+func (c *CompilationCache) compile(ctx context.Context, r wazero.Runtime, wasm []byte) (wazero.CompiledModule, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entry(wasm)
+	before := modTime(entry)
+	code, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		return nil, false, err
+	}
+	hit := !before.IsZero() && before.Equal(modTime(entry))
+	if hit {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return code, hit, nil
+}
+
+// entry is the path wazero's file cache stores the compiled wasm under: a
+// directory for the wazero version and platform, and a file named by the
+// hash of wasm and the two flags wazero compiles in, of which only closing
+// modules when the context is done is set.
+func (c *CompilationCache) entry(wasm []byte) string {
+	key := sha256.Sum256(append(wasm[:len(wasm):len(wasm)], 0, 1))
+	dir, err := filepath.Abs(c.dir)
+	if err != nil {
+		dir = c.dir
+	}
+	return filepath.Join(dir, "wazero-"+wazeroVersion()+"-"+runtime.GOARCH+"-"+runtime.GOOS, hex.EncodeToString(key[:]))
+}
+
+// wazeroVersion returns the version of wazero this binary is built with, as
+// wazero itself determines it to name its cache directory.
+func wazeroVersion() string {
+	var v string
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if strings.Contains(dep.Path, "github.com/tetratelabs/wazero") {
+				v = dep.Version
+			}
+		}
+		if v == "" || v == "(devel)" {
+			v = info.Main.Version
+		}
+	}
+	if v == "" || v == "(devel)" {
+		return "dev"
+	}
+	return v
+}
+
+func modTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
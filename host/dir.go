@@ -0,0 +1,71 @@
+package host
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+var (
+	errNotDir = errors.New("not a directory")
+	errIsDir  = errors.New("is a directory")
+)
+
+// pluginDir is an open directory of a PluginFS. Its entries are a snapshot
+// taken when it was opened.
+type pluginDir struct {
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+// Close implements fs.File
+func (d *pluginDir) Close() error { return nil }
+
+// Stat implements fs.File
+func (d *pluginDir) Stat() (fs.FileInfo, error) {
+	return dirInfo(d.name), nil
+}
+
+// Read implements fs.File
+func (d *pluginDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *pluginDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+// dirInfo describes the PluginFS directory at its path.
+type dirInfo string
+
+func (d dirInfo) Name() string       { return path.Base(string(d)) }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d dirInfo) ModTime() time.Time { return time.Time{} }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() any           { return nil }
+
+// renamedInfo is a FileInfo listed under another name, like a stream's in
+// channel listed as in/<id>.
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (r renamedInfo) Name() string { return r.name }
@@ -0,0 +1,360 @@
+package host
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DispatcherConfig sets the concurrency of a Dispatcher and how it shares
+// its workers between tenants.
+type DispatcherConfig struct {
+	// Workers is the number of streams run at once. It defaults to the
+	// pool's MaxSize.
+	Workers int
+	// QueueSize is the number of streams that can be queued before Submit
+	// blocks. Zero means Submit blocks until a worker is free.
+	QueueSize int
+	// Weights sets the share of workers each tenant gets while several have
+	// streams queued. Tenants not listed have a weight of 1.
+	Weights map[string]int
+}
+
+// DispatcherStats is a snapshot of a Dispatcher's work.
+type DispatcherStats struct {
+	// Queued counts the streams submitted that no worker has started,
+	// including those whose Submit is still blocked.
+	Queued  int
+	Running int
+	Done    uint64
+	// Tenants breaks down the streams accepted by Submit by tenant. A
+	// tenant is dropped, along with its Done count, once it has no streams
+	// queued or running and hasn't used more than its share.
+	Tenants map[string]TenantStats
+}
+
+// TenantStats is a snapshot of one tenant's work in a Dispatcher.
+type TenantStats struct {
+	Queued  int
+	Running int
+	Done    uint64
+}
+
+// Job is a stream to be run by a Dispatcher.
+type Job struct {
+	ID string
+	// Tenant is the key streams are shared out by.
+	Tenant string
+	// Priority orders a tenant's queued streams. Higher runs first, and
+	// streams of equal priority run in the order they were submitted.
+	Priority int
+}
+
+// Result is the outcome of a stream run by a Dispatcher.
+type Result struct {
+	ID  string
+	Err error
+	// Wait is the time the stream spent queued, and Run the time it spent
+	// in Pool.Do.
+	Wait time.Duration
+	Run  time.Duration
+}
+
+// Dispatcher runs streams on a Pool from a shared queue, so each worker
+// takes the next stream as soon as it finishes one, however long the
+// streams before it took. It is safe for concurrent use.
+//
+// Workers are shared between tenants by weighted fair queuing: while
+// several tenants have streams queued, each gets a number of streams started
+// in proportion to its weight, whatever their priorities, so one tenant's
+// bulk work can't starve another's. A tenant doesn't build up credit while
+// it has nothing queued.
+type Dispatcher struct {
+	run func(ctx context.Context, id string) error
+	// finish, if set, finishes a stream that won't be run because
+	// submitting it failed.
+	finish  func(id string, err error)
+	weights map[string]int
+	// space holds a token for each stream queued or running, bounding
+	// them to QueueSize plus Workers.
+	space chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	ready   sync.Cond
+	closed  bool
+	seq     uint64
+	tenants map[string]*tenant
+	// active are the tenants with streams queued, and vtime the pass of
+	// the tenant last picked. idle are the tenants with nothing queued or
+	// running that are kept while they are ahead of vtime and others have
+	// streams queued, so that going idle doesn't reset the share they have
+	// used.
+	active []*tenant
+	idle   []*tenant
+	vtime  uint64
+
+	queued  int64
+	running int64
+	done    uint64
+}
+
+// strideScale is the pass a tenant of weight 1 advances by for each stream
+// started.
+const strideScale = 1 << 20
+
+// tenant is the queue of one tenant's streams.
+type tenant struct {
+	name    string
+	stride  uint64
+	pass    uint64
+	jobs    jobQueue
+	running int
+	done    uint64
+	// parked is set while the tenant is in Dispatcher.idle.
+	parked bool
+}
+
+type job struct {
+	ctx context.Context
+	Job
+	seq    uint64
+	queued time.Time
+	done   func(Result)
+}
+
+// jobQueue is a heap of jobs by priority, then submission order.
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *jobQueue) Push(x any)   { *q = append(*q, x.(*job)) }
+func (q *jobQueue) Pop() any {
+	old := *q
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return j
+}
+
+// NewDispatcher starts the workers of a Dispatcher running streams on p.
+func NewDispatcher(p *Pool, config DispatcherConfig) *Dispatcher {
+	if config.Workers <= 0 {
+		config.Workers = p.config.MaxSize
+	}
+	d := newDispatcher(p.Do, config)
+	d.finish = p.engine.finish
+	return d
+}
+
+// newDispatcher starts config.Workers workers running streams with run.
+func newDispatcher(run func(ctx context.Context, id string) error, config DispatcherConfig) *Dispatcher {
+	d := &Dispatcher{
+		run:     run,
+		weights: config.Weights,
+		space:   make(chan struct{}, config.Workers+config.QueueSize),
+		tenants: make(map[string]*tenant),
+	}
+	d.ready.L = &d.mu
+	d.wg.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		t, j := d.next()
+		if j == nil {
+			return
+		}
+		start := time.Now()
+		err := d.run(j.ctx, j.ID)
+		res := Result{ID: j.ID, Err: err, Wait: start.Sub(j.queued), Run: time.Since(start)}
+
+		d.mu.Lock()
+		t.running--
+		t.done++
+		if t.running == 0 && t.jobs.Len() == 0 {
+			d.prune(t)
+		}
+		d.mu.Unlock()
+		atomic.AddInt64(&d.running, -1)
+		atomic.AddUint64(&d.done, 1)
+		<-d.space
+		if j.done != nil {
+			j.done(res)
+		}
+	}
+}
+
+// next waits for a queued stream and returns it with its tenant, or nil
+// once the Dispatcher is closed and drained.
+func (d *Dispatcher) next() (*tenant, *job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.active) == 0 {
+		if d.closed {
+			return nil, nil
+		}
+		d.ready.Wait()
+	}
+
+	pick := 0
+	for i, t := range d.active {
+		if t.pass < d.active[pick].pass {
+			pick = i
+		}
+	}
+	t := d.active[pick]
+	j := heap.Pop(&t.jobs).(*job)
+	d.vtime = t.pass
+	t.pass += t.stride
+	t.running++
+	if t.jobs.Len() == 0 {
+		d.active = append(d.active[:pick], d.active[pick+1:]...)
+	}
+	d.sweep()
+	atomic.AddInt64(&d.queued, -1)
+	atomic.AddInt64(&d.running, 1)
+	return t, j
+}
+
+// prune parks t, which has nothing queued or running, in idle until sweep
+// drops it. It must be called with d.mu held.
+func (d *Dispatcher) prune(t *tenant) {
+	if !t.parked {
+		t.parked = true
+		d.idle = append(d.idle, t)
+	}
+	d.sweep()
+}
+
+// sweep drops the idle tenants that have fallen back to vtime, or all of
+// them once no tenant has streams queued, and unparks those that have
+// streams again. It must be called with d.mu held.
+func (d *Dispatcher) sweep() {
+	idle := d.idle[:0]
+	for _, t := range d.idle {
+		switch {
+		case t.running > 0 || t.jobs.Len() > 0:
+			t.parked = false
+		case t.pass <= d.vtime || len(d.active) == 0:
+			t.parked = false
+			delete(d.tenants, t.name)
+		default:
+			idle = append(idle, t)
+		}
+	}
+	for i := len(idle); i < len(d.idle); i++ {
+		d.idle[i] = nil
+	}
+	d.idle = idle
+}
+
+// Submit queues the stream registered under id to be run with ctx, as a
+// Job with no tenant or priority.
+func (d *Dispatcher) Submit(ctx context.Context, id string, done func(Result)) error {
+	return d.SubmitJob(ctx, Job{ID: id}, done)
+}
+
+// SubmitJob queues j to be run with ctx, blocking while the queue is full.
+// done, if not nil, is called from the worker with the result. SubmitJob
+// returns a TimeoutError if ctx ends before the stream is queued, and
+// ErrClosed once the Dispatcher is closed, in which case the stream is
+// finished with the error as by Pool.Do and done isn't called.
+func (d *Dispatcher) SubmitJob(ctx context.Context, j Job, done func(Result)) error {
+	atomic.AddInt64(&d.queued, 1)
+	select {
+	case d.space <- struct{}{}:
+	case <-ctx.Done():
+		atomic.AddInt64(&d.queued, -1)
+		return d.abort(j.ID, &TimeoutError{ID: j.ID, Err: ctx.Err()})
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		atomic.AddInt64(&d.queued, -1)
+		<-d.space
+		return d.abort(j.ID, ErrClosed)
+	}
+	defer d.mu.Unlock()
+	t, ok := d.tenants[j.Tenant]
+	if !ok {
+		weight := d.weights[j.Tenant]
+		if weight <= 0 {
+			weight = 1
+		}
+		t = &tenant{name: j.Tenant, stride: strideScale / uint64(weight)}
+		if t.stride == 0 {
+			t.stride = 1
+		}
+		d.tenants[j.Tenant] = t
+	}
+	if t.jobs.Len() == 0 {
+		if t.pass < d.vtime {
+			t.pass = d.vtime
+		}
+		d.active = append(d.active, t)
+	}
+	d.seq++
+	heap.Push(&t.jobs, &job{ctx: ctx, Job: j, seq: d.seq, queued: time.Now(), done: done})
+	d.ready.Signal()
+	return nil
+}
+
+// abort finishes the stream registered under id, which won't be run because
+// submitting it failed with err, and returns err.
+func (d *Dispatcher) abort(id string, err error) error {
+	if d.finish != nil {
+		d.finish(id, err)
+	}
+	return err
+}
+
+// Do runs the stream registered under id like Pool.Do, after the streams
+// queued before it.
+func (d *Dispatcher) Do(ctx context.Context, id string) error {
+	result := make(chan error, 1)
+	if err := d.Submit(ctx, id, func(r Result) { result <- r.Err }); err != nil {
+		return err
+	}
+	return <-result
+}
+
+// Stats returns the current queue depth and work counts.
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	tenants := make(map[string]TenantStats, len(d.tenants))
+	for name, t := range d.tenants {
+		tenants[name] = TenantStats{Queued: t.jobs.Len(), Running: t.running, Done: t.done}
+	}
+	d.mu.Unlock()
+	return DispatcherStats{
+		Queued:  int(atomic.LoadInt64(&d.queued)),
+		Running: int(atomic.LoadInt64(&d.running)),
+		Done:    atomic.LoadUint64(&d.done),
+		Tenants: tenants,
+	}
+}
+
+// Close stops accepting streams and waits for the queued ones to finish. It
+// doesn't close the pool.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.ready.Broadcast()
+	d.mu.Unlock()
+	d.wg.Wait()
+}
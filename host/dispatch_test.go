@@ -0,0 +1,251 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gatedRunner runs streams on a single worker, recording the order they
+// start in. A stream named gate blocks the worker until it is opened, so
+// that the streams submitted meanwhile are picked from a full queue.
+type gatedRunner struct {
+	started chan struct{}
+	open    chan struct{}
+
+	mu    sync.Mutex
+	order []string
+}
+
+func newGatedRunner() *gatedRunner {
+	return &gatedRunner{started: make(chan struct{}), open: make(chan struct{})}
+}
+
+func (g *gatedRunner) run(ctx context.Context, id string) error {
+	if id == "gate" {
+		g.started <- struct{}{}
+		<-g.open
+		return nil
+	}
+	g.mu.Lock()
+	g.order = append(g.order, id)
+	g.mu.Unlock()
+	return nil
+}
+
+// batch blocks the worker, submits jobs, lets the worker run them and
+// returns the order they ran in.
+func (g *gatedRunner) batch(t *testing.T, d *Dispatcher, jobs ...Job) []string {
+	t.Helper()
+	ctx := context.Background()
+	if err := d.SubmitJob(ctx, Job{ID: "gate", Tenant: "gate"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-g.started
+
+	var wg sync.WaitGroup
+	wg.Add(len(jobs))
+	for _, j := range jobs {
+		if err := d.SubmitJob(ctx, j, func(Result) { wg.Done() }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.open <- struct{}{}
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	order := g.order
+	g.order = nil
+	return order
+}
+
+func tenantOf(id string) string { return strings.SplitN(id, "-", 2)[0] }
+
+func TestDispatcherWeights(t *testing.T) {
+	g := newGatedRunner()
+	d := newDispatcher(g.run, DispatcherConfig{
+		Workers:   1,
+		QueueSize: 100,
+		Weights:   map[string]int{"a": 3},
+	})
+	defer d.Close()
+
+	var jobs []Job
+	for i := 0; i < 20; i++ {
+		jobs = append(jobs, Job{ID: "a-" + string(rune('a'+i)), Tenant: "a"})
+		jobs = append(jobs, Job{ID: "b-" + string(rune('a'+i)), Tenant: "b"})
+	}
+	order := g.batch(t, d, jobs...)
+
+	// While both have streams queued, a gets three for each of b's.
+	var a int
+	for _, id := range order[:20] {
+		if tenantOf(id) == "a" {
+			a++
+		}
+	}
+	if a != 15 {
+		t.Errorf("a ran %d of the first 20 streams, want 15: %v", a, order)
+	}
+}
+
+func TestDispatcherIdleTenantEarnsNoCredit(t *testing.T) {
+	g := newGatedRunner()
+	d := newDispatcher(g.run, DispatcherConfig{Workers: 1, QueueSize: 100})
+	defer d.Close()
+
+	// a runs alone for a while, then b joins it.
+	var jobs []Job
+	for i := 0; i < 10; i++ {
+		jobs = append(jobs, Job{ID: "a-" + string(rune('a'+i)), Tenant: "a"})
+	}
+	g.batch(t, d, jobs...)
+
+	jobs = nil
+	for i := 0; i < 4; i++ {
+		jobs = append(jobs, Job{ID: "a-" + string(rune('a'+i)), Tenant: "a"})
+		jobs = append(jobs, Job{ID: "b-" + string(rune('a'+i)), Tenant: "b"})
+	}
+	order := g.batch(t, d, jobs...)
+	for i := 1; i < len(order); i++ {
+		if tenantOf(order[i]) == tenantOf(order[i-1]) {
+			t.Fatalf("tenants of equal weight didn't alternate: %v", order)
+		}
+	}
+}
+
+func TestDispatcherPriority(t *testing.T) {
+	g := newGatedRunner()
+	d := newDispatcher(g.run, DispatcherConfig{Workers: 1, QueueSize: 100})
+	defer d.Close()
+
+	order := g.batch(t, d,
+		Job{ID: "low", Priority: 1},
+		Job{ID: "high-1", Priority: 3},
+		Job{ID: "mid", Priority: 2},
+		Job{ID: "high-2", Priority: 3},
+	)
+	want := []string{"high-1", "high-2", "mid", "low"}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+}
+
+func TestDispatcherPrunesTenants(t *testing.T) {
+	g := newGatedRunner()
+	d := newDispatcher(g.run, DispatcherConfig{Workers: 1, QueueSize: 100})
+	defer d.Close()
+
+	var jobs []Job
+	for i := 0; i < 50; i++ {
+		tenant := "t" + string(rune('a'+i))
+		jobs = append(jobs, Job{ID: tenant + "-a", Tenant: tenant})
+	}
+	g.batch(t, d, jobs...)
+
+	if n := len(d.Stats().Tenants); n != 0 {
+		t.Errorf("%d tenants kept after their streams finished", n)
+	}
+}
+
+func TestDispatcherSerialTenantKeepsShare(t *testing.T) {
+	g := newGatedRunner()
+	d := newDispatcher(g.run, DispatcherConfig{
+		Workers:   1,
+		QueueSize: 100,
+		Weights:   map[string]int{"b": 4},
+	})
+	defer d.Close()
+
+	// a never has more than one stream queued or running, so it has
+	// nothing at all between finishing a stream and submitting the next.
+	ctx := context.Background()
+	var submit func(i int)
+	submit = func(i int) {
+		if i == 20 {
+			return
+		}
+		d.SubmitJob(ctx, Job{ID: "a-" + string(rune('a'+i)), Tenant: "a"}, func(Result) { submit(i + 1) })
+	}
+	var jobs []Job
+	for i := 0; i < 60; i++ {
+		jobs = append(jobs, Job{ID: "b-" + string(rune('a'+i)), Tenant: "b"})
+	}
+	if err := d.SubmitJob(ctx, Job{ID: "gate", Tenant: "gate"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-g.started
+	submit(0)
+	var wg sync.WaitGroup
+	wg.Add(len(jobs))
+	for _, j := range jobs {
+		if err := d.SubmitJob(ctx, j, func(Result) { wg.Done() }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.open <- struct{}{}
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var a int
+	for _, id := range g.order[:50] {
+		if tenantOf(id) == "a" {
+			a++
+		}
+	}
+	if a < 9 || a > 11 {
+		t.Errorf("a ran %d of the first 50 streams, want 10: %v", a, g.order[:50])
+	}
+}
+
+func TestDispatcherFinishesRejectedStreams(t *testing.T) {
+	pfs := NewPluginFS()
+	readers := make(map[string]*PipeReader)
+	for _, id := range []string{"a", "b"} {
+		r, w := NewPipe(0)
+		if err := pfs.Register(id, NewInFile(bytes.NewReader(nil)), NewOutFile(w)); err != nil {
+			t.Fatal(err)
+		}
+		readers[id] = r
+	}
+	p, err := NewPool(context.Background(), &Engine{streams: pfs}, PoolConfig{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-p.slots // Check out the only instance, so the worker waits for it.
+	d := NewDispatcher(p, DispatcherConfig{Workers: 1})
+
+	// Fill the queue with a stream whose wait for an instance ends with
+	// its context.
+	gateCtx, openGate := context.WithCancel(context.Background())
+	if err := d.Submit(gateCtx, "gate", nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = d.Do(ctx, "a")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Do on a full queue: %v, want ErrTimeout", err)
+	}
+	if _, rerr := io.ReadAll(readers["a"]); rerr != err {
+		t.Errorf("reading a: %v, want %v", rerr, err)
+	}
+
+	openGate()
+	d.Close()
+	if err := d.Do(context.Background(), "b"); err != ErrClosed {
+		t.Fatalf("Do after Close: %v, want ErrClosed", err)
+	}
+	if _, err := io.ReadAll(readers["b"]); err != ErrClosed {
+		t.Errorf("reading b: %v, want ErrClosed", err)
+	}
+	if n := pfs.Len(); n != 0 {
+		t.Errorf("%d streams left registered", n)
+	}
+}
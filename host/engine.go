@@ -0,0 +1,218 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Engine compiles a plugin once and instantiates it any number of times
+// inside a single wazero runtime. It is safe for concurrent use.
+type Engine struct {
+	r      wazero.Runtime
+	code   wazero.CompiledModule
+	config wazero.ModuleConfig
+	name   string
+	seq    uint64
+
+	// streams is the engine's filesystem if it is a PluginFS.
+	streams   *PluginFS
+	transport Transport
+
+	// abandoned counts guest calls given up on by Runtime.Do that may
+	// still be executing compiled code.
+	abandoned     int32
+	abandonedDone sync.WaitGroup
+	unreleased    uint64
+}
+
+// EngineConfig configures an Engine.
+type EngineConfig struct {
+	// Cache, if set, persists the compiled plugin so that engines created
+	// by later processes skip compilation.
+	Cache *CompilationCache
+	// Transport selects how plugins move stream data. TransportHost
+	// requires the engine's filesystem to be a *PluginFS.
+	Transport Transport
+	// Interpreter runs the plugin with wazero's interpreter instead of
+	// compiling it to native code. It can't be combined with Cache.
+	Interpreter bool
+}
+
+// NewEngine compiles the plugin wasm. Instances share f as their filesystem.
+func NewEngine(ctx context.Context, wasm []byte, f fs.FS) (*Engine, error) {
+	return NewEngineWithConfig(ctx, wasm, f, EngineConfig{})
+}
+
+// NewEngineWithConfig is like NewEngine, but configured by config.
+func NewEngineWithConfig(ctx context.Context, wasm []byte, f fs.FS, config EngineConfig) (*Engine, error) {
+	streams, _ := f.(*PluginFS)
+	if config.Transport == TransportHost && streams == nil {
+		return nil, errors.New("host transport requires a *PluginFS")
+	}
+
+	var r wazero.Runtime
+	var err error
+	switch {
+	case config.Interpreter && config.Cache != nil:
+		return nil, errors.New("the interpreter can't use a compilation cache")
+	case config.Interpreter:
+		r = wazero.NewRuntimeWithConfig(ctx, newRuntimeConfig(wazero.NewRuntimeConfigInterpreter()))
+	case config.Cache != nil:
+		r = config.Cache.newRuntime(ctx)
+	default:
+		r = wazero.NewRuntimeWithConfig(ctx, newRuntimeConfig(wazero.NewRuntimeConfig()))
+	}
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("instantiate wasi: %w", err)
+	}
+	if err = instantiateStream(ctx, r, streams, config.Transport); err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("instantiate %s: %w", streamModule, err)
+	}
+	var code wazero.CompiledModule
+	if config.Cache != nil {
+		code, _, err = config.Cache.compile(ctx, r, wasm)
+	} else {
+		code, err = r.CompileModule(ctx, wasm)
+	}
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("compile plugin: %w", err)
+	}
+	if err = checkABI(code); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	name := code.Name()
+	if name == "" {
+		name = "plugin"
+	}
+
+	return &Engine{
+		r:    r,
+		code: code,
+		config: wazero.
+			NewModuleConfig().
+			WithStdout(os.Stdout).
+			WithStderr(os.Stderr).
+			WithStdin(os.Stdin).
+			WithFS(f).
+			WithStartFunctions("_start", "_initialize"),
+		name:      name,
+		streams:   streams,
+		transport: config.Transport,
+	}, nil
+}
+
+// newRuntimeConfig returns config set up as every engine's runtime is: guest
+// calls are stopped once their context is done, so that calls abandoned by
+// Runtime.Do don't run on.
+func newRuntimeConfig(config wazero.RuntimeConfig) wazero.RuntimeConfig {
+	return config.WithCloseOnContextDone(true)
+}
+
+// Instantiate returns a new, uniquely named instance of the plugin.
+func (e *Engine) Instantiate(ctx context.Context) (*Runtime, error) {
+	name := fmt.Sprintf("%s-%d", e.name, atomic.AddUint64(&e.seq, 1))
+	mod, err := e.r.InstantiateModule(ctx, e.code, e.config.WithName(name))
+	if err != nil {
+		if exitErr, ok := err.(*sys.ExitError); !ok || exitErr.ExitCode() != 0 {
+			return nil, callError("_start", err)
+		}
+	}
+	do := mod.ExportedFunction("do")
+	if do == nil {
+		mod.Close(ctx)
+		return nil, &ExportError{Name: "do"}
+	}
+	malloc := mod.ExportedFunction("my_malloc")
+	if malloc == nil {
+		mod.Close(ctx)
+		return nil, &ExportError{Name: "my_malloc"}
+	}
+	free := mod.ExportedFunction("my_free")
+	if free == nil {
+		mod.Close(ctx)
+		return nil, &ExportError{Name: "my_free"}
+	}
+	errorMessage := mod.ExportedFunction("error_message")
+	if errorMessage == nil {
+		mod.Close(ctx)
+		return nil, &ExportError{Name: "error_message"}
+	}
+
+	return &Runtime{
+		R:            e.r,
+		Mod:          mod,
+		malloc:       malloc,
+		free:         free,
+		do:           do,
+		errorMessage: errorMessage,
+		allocs:       make(map[uint32]uint32),
+		engine:       e,
+	}, nil
+}
+
+// Unreleased returns the number of guest buffers that instances of this
+// engine had not given back with my_free when they were closed.
+func (e *Engine) Unreleased() uint64 {
+	return atomic.LoadUint64(&e.unreleased)
+}
+
+// Abandoned returns the number of guest calls Runtime.Do stopped waiting
+// for that are still running.
+func (e *Engine) Abandoned() int {
+	return int(atomic.LoadInt32(&e.abandoned))
+}
+
+// begin marks a call on the stream registered under id as in progress if
+// the engine's filesystem is a PluginFS.
+func (e *Engine) begin(id string) {
+	if e.streams != nil {
+		e.streams.begin(id)
+	}
+}
+
+// finish finishes the stream registered under id if the engine's filesystem
+// is a PluginFS.
+func (e *Engine) finish(id string, err error) {
+	if e.streams != nil {
+		e.streams.finish(id, err)
+	}
+}
+
+// abandon records a guest call that Runtime.Do stopped waiting for. done
+// receives its result once the guest returns.
+func (e *Engine) abandon(done <-chan error) {
+	atomic.AddInt32(&e.abandoned, 1)
+	e.abandonedDone.Add(1)
+	go func() {
+		<-done
+		atomic.AddInt32(&e.abandoned, -1)
+		e.abandonedDone.Done()
+	}()
+}
+
+// Close closes every instance and releases the compiled plugin. If calls
+// abandoned by Runtime.Do are still running, the release happens once they
+// return.
+func (e *Engine) Close(ctx context.Context) error {
+	if atomic.LoadInt32(&e.abandoned) == 0 {
+		return e.r.Close(ctx)
+	}
+	go func() {
+		e.abandonedDone.Wait()
+		e.r.Close(context.Background())
+	}()
+	return nil
+}
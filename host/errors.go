@@ -0,0 +1,118 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var (
+	// ErrMissingExport is matched by an ExportError.
+	ErrMissingExport = errors.New("missing export")
+	// ErrMemoryRange is matched by a MemoryError.
+	ErrMemoryRange = errors.New("memory access out of range")
+	// ErrTrap is matched by a TrapError.
+	ErrTrap = errors.New("guest trap")
+	// ErrExit is matched by an ExitError.
+	ErrExit = errors.New("guest exit")
+	// ErrStreamFailed is matched by a StreamError.
+	ErrStreamFailed = errors.New("plugin failed to process stream")
+	// ErrTimeout is matched by a TimeoutError.
+	ErrTimeout = errors.New("plugin call timed out")
+	// ErrClosed is returned by calls on a Runtime that has been closed,
+	// including one closed because a call's context ended.
+	ErrClosed = errors.New("runtime closed")
+)
+
+// ExportError reports a function the plugin was expected to export but
+// didn't.
+type ExportError struct {
+	Name string
+}
+
+func (e *ExportError) Error() string {
+	return fmt.Sprintf("plugin does not export %q", e.Name)
+}
+
+func (e *ExportError) Is(target error) bool { return target == ErrMissingExport }
+
+// MemoryError reports an access to guest memory outside its current size.
+type MemoryError struct {
+	Offset uint32
+	Length uint32
+	Size   uint32
+}
+
+func (e *MemoryError) Error() string {
+	return fmt.Sprintf("memory access [%d, +%d) out of range of memory size %d",
+		e.Offset, e.Length, e.Size)
+}
+
+func (e *MemoryError) Is(target error) bool { return target == ErrMemoryRange }
+
+// TrapError reports a guest function that aborted, for example on
+// unreachable or an out of bounds access inside the guest.
+type TrapError struct {
+	Func string
+	Err  error
+}
+
+func (e *TrapError) Error() string {
+	return fmt.Sprintf("%s trapped: %v", e.Func, e.Err)
+}
+
+func (e *TrapError) Is(target error) bool { return target == ErrTrap }
+func (e *TrapError) Unwrap() error        { return e.Err }
+
+// ExitError reports a guest that called proc_exit with a non-zero code.
+type ExitError struct {
+	Func string
+	Code uint32
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s exited with code %d", e.Func, e.Code)
+}
+
+func (e *ExitError) Is(target error) bool { return target == ErrExit }
+
+// StreamError reports a stream the plugin ran to completion on but failed to
+// process, with the non-zero status it returned from do and its message.
+type StreamError struct {
+	ID      string
+	Status  uint32
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("stream %s: plugin failed with status %d", e.ID, e.Status)
+	}
+	return fmt.Sprintf("stream %s: plugin failed with status %d: %s", e.ID, e.Status, e.Message)
+}
+
+func (e *StreamError) Is(target error) bool { return target == ErrStreamFailed }
+
+// TimeoutError reports a call abandoned because its context was cancelled or
+// its deadline passed. Err is the context's error.
+type TimeoutError struct {
+	ID  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("stream %s: %v", e.ID, e.Err)
+}
+
+func (e *TimeoutError) Is(target error) bool { return target == ErrTimeout }
+func (e *TimeoutError) Unwrap() error        { return e.Err }
+
+// callError classifies an error returned by calling the guest function fn.
+func callError(fn string, err error) error {
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Func: fn, Code: exitErr.ExitCode()}
+	}
+	return &TrapError{Func: fn, Err: err}
+}
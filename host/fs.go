@@ -0,0 +1,607 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ fs.File        = &PluginFile{}
+	_ io.ReadCloser  = &PluginFile{}
+	_ io.Writer      = &PluginFile{}
+	_ fs.FileInfo    = &PluginFile{}
+	_ io.Seeker      = &PluginFile{}
+	_ io.ReaderAt    = &PluginFile{}
+	_ fs.FS          = &PluginFS{}
+	_ fs.ReadDirFS   = &PluginFS{}
+	_ fs.ReadDirFile = &pluginDir{}
+	_ io.ReadCloser  = &inHandle{}
+	_ io.WriteCloser = &outHandle{}
+	_ io.ReadSeeker  = &seekInHandle{}
+	_ io.ReaderAt    = &seekInHandle{}
+)
+
+// ErrWrongDirection is returned for reading a stream's output or writing its
+// input. Plugins see EBADF for both under TransportHost. Under TransportFile
+// they see EBADF for writing an input, whose handle has no Write method, but
+// EIO for reading an output, as every fs.File must have a Read method and
+// WASI fd_read reports its errors as EIO.
+var ErrWrongDirection = errors.New("wrong direction for stream file")
+
+// ErrNotSeekable is returned for seeking, or reading at an offset, a stream
+// file whose source doesn't support it.
+var ErrNotSeekable = errors.New("stream file is not seekable")
+
+// ErrBusy is returned for opening a stream file that its PluginFS's
+// OpenPolicy doesn't allow to be opened again. Plugins see EBUSY under
+// TransportHost, but EIO under TransportFile, as WASI path_open reports
+// errors other than fs.ErrNotExist and fs.ErrExist that way.
+var ErrBusy = errors.New("stream file already open")
+
+// OpenPolicy decides what happens when a stream's input is opened more than
+// once. An output can only ever be opened once. Opens refused by the policy
+// fail with ErrBusy.
+type OpenPolicy int
+
+const (
+	// OpenExclusive lets each stream file be opened once. Later opens fail
+	// with ErrBusy.
+	OpenExclusive OpenPolicy = iota
+	// OpenReplay gives every open of an input its own handle reading the
+	// whole input from the start. The input is buffered in memory as it is
+	// read, until the stream is removed.
+	OpenReplay
+)
+
+// PluginFSConfig configures a PluginFS.
+type PluginFSConfig struct {
+	OpenPolicy OpenPolicy
+}
+
+// PluginFile is a channel of a stream as seen by the plugin: either an input
+// it reads from, such as streams/<id>/in, or an output it writes to, such as
+// streams/<id>/out.
+type PluginFile struct {
+	name    string
+	reader  io.Reader
+	writer  io.WriteCloser
+	mode    bool
+	created time.Time
+	// written counts the bytes written to an output file.
+	written   atomic.Int64
+	closeOnce sync.Once
+	// finished is set once the call on the file's stream has finished, so
+	// that handles a timed out plugin still holds fail.
+	finished atomic.Bool
+
+	// fs and id are set, and name replaced by the channel name, when the
+	// file is registered, so that closing it can remove the stream once all
+	// of its channels are closed. The rest is
+	// guarded by fs.fsMu: opened counts the handles ever opened on the file
+	// and handles those still open, and replay buffers the input for
+	// OpenReplay.
+	fs      *PluginFS
+	id      string
+	closed  bool
+	opened  int
+	handles int
+	replay  *replayBuffer
+
+	// meta is the contents of a meta channel, which is never closed.
+	meta []byte
+}
+
+// NewInFile returns an input channel of a stream, read by the plugin from r.
+func NewInFile(r io.Reader) *PluginFile {
+	return &PluginFile{
+		name:    "in",
+		mode:    false,
+		reader:  r,
+		created: time.Now(),
+	}
+}
+
+// NewOutFile returns an output channel of a stream, written by the plugin to w.
+// w is closed when the plugin closes the file, or if that happens during a
+// call on its stream, once Runtime.Do returns.
+func NewOutFile(w io.WriteCloser) *PluginFile {
+	return &PluginFile{
+		name:    "out",
+		mode:    true,
+		writer:  w,
+		created: time.Now(),
+	}
+}
+
+func (f *PluginFile) ModTime() time.Time         { return f.created }
+func (f *PluginFile) IsDir() bool                { return false }
+func (f *PluginFile) Sys() any                   { return nil }
+func (f *PluginFile) Type() fs.FileMode          { return f.Mode().Type() }
+func (f *PluginFile) Info() (fs.FileInfo, error) { return f, nil }
+
+// Name implements fs.FileInfo. It is the name of the file's channel.
+func (f *PluginFile) Name() string { return f.name }
+
+// Mode implements fs.FileInfo. Inputs are read-only and outputs write-only.
+func (f *PluginFile) Mode() fs.FileMode {
+	if f.mode {
+		return 0222
+	}
+	return 0444
+}
+
+// Size implements fs.FileInfo. For an input it is the total size of the
+// reader if it reports one, through a Stat method like *os.File or a Size
+// method like *bytes.Reader, however much has been read, and 0 otherwise.
+// Readers that only know what is left to read, like *bytes.Buffer, report 0.
+// For an output it is the number of bytes written so far.
+func (f *PluginFile) Size() int64 {
+	if f.mode {
+		return f.written.Load()
+	}
+	switch r := f.reader.(type) {
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil {
+			return fi.Size()
+		}
+	case interface{ Size() int64 }:
+		return r.Size()
+	}
+	return 0
+}
+
+// Close implements fs.File. Closing a file again does nothing.
+func (i *PluginFile) Close() error {
+	if i.fs != nil {
+		i.fs.fileClosed(i)
+	} else {
+		i.closeWriter(nil)
+	}
+	return nil
+}
+
+// closeWriter closes an output's writer, with err if it isn't nil and the
+// writer has a CloseWithError method like io.PipeWriter, so its reader sees
+// err instead of the end of the stream.
+func (i *PluginFile) closeWriter(err error) {
+	if !i.mode {
+		return
+	}
+	i.closeOnce.Do(func() {
+		if w, ok := i.writer.(interface{ CloseWithError(error) error }); ok && err != nil {
+			w.CloseWithError(err)
+		} else {
+			i.writer.Close()
+		}
+	})
+}
+
+// Stat implements fs.File
+func (i *PluginFile) Stat() (fs.FileInfo, error) {
+	return i, nil
+}
+
+// Read implements io.Reader
+func (i *PluginFile) Read(p []byte) (n int, err error) {
+	if i.mode {
+		return 0, &fs.PathError{Op: "read", Path: i.path(), Err: ErrWrongDirection}
+	}
+	return i.reader.Read(p)
+}
+
+// Seek implements io.Seeker for an input whose reader does.
+func (i *PluginFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := i.reader.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "seek", Path: i.path(), Err: ErrNotSeekable}
+	}
+	return s.Seek(offset, whence)
+}
+
+// ReadAt implements io.ReaderAt for an input whose reader implements it, or
+// io.Seeker, in which case the offset is restored after reading.
+func (i *PluginFile) ReadAt(p []byte, off int64) (int, error) {
+	switch r := i.reader.(type) {
+	case io.ReaderAt:
+		return r.ReadAt(p, off)
+	case io.ReadSeeker:
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err := io.ReadFull(r, p)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if _, serr := r.Seek(cur, io.SeekStart); serr != nil && err == nil {
+			err = serr
+		}
+		return n, err
+	default:
+		return 0, &fs.PathError{Op: "read", Path: i.path(), Err: ErrNotSeekable}
+	}
+}
+
+// seekable reports whether the file is an input whose reader supports
+// io.Seeker.
+func (i *PluginFile) seekable() bool {
+	_, ok := i.reader.(io.Seeker)
+	return ok
+}
+
+// Write implements io.Writeer
+func (i *PluginFile) Write(p []byte) (n int, err error) {
+	if !i.mode {
+		return 0, &fs.PathError{Op: "write", Path: i.path(), Err: ErrWrongDirection}
+	}
+	n, err = i.writer.Write(p)
+	i.written.Add(int64(n))
+	return n, err
+}
+
+// open returns a new handle on f according to policy, whose Stat reports
+// name, the base of the path it was opened by. It must be called with
+// f.fs.fsMu held.
+func (f *PluginFile) open(policy OpenPolicy, name string) (fs.File, error) {
+	var info fs.FileInfo = f
+	if name != f.name {
+		info = renamedInfo{f, name}
+	}
+	if f.meta != nil {
+		return &seekInHandle{inHandle{f: f, r: bytes.NewReader(f.meta), info: info}}, nil
+	}
+	if f.busy(policy) {
+		return nil, &fs.PathError{Op: "open", Path: f.path(), Err: ErrBusy}
+	}
+	f.opened++
+	f.handles++
+	if f.mode {
+		return &outHandle{f: f, info: info}, nil
+	}
+	if policy != OpenReplay {
+		if f.seekable() {
+			return &seekInHandle{inHandle{f: f, r: f, info: info}}, nil
+		}
+		return &inHandle{f: f, r: f, info: info}, nil
+	}
+	if f.replay == nil {
+		f.replay = &replayBuffer{src: f}
+	}
+	return &seekInHandle{inHandle{f: f, r: &replayReader{buf: f.replay}, info: info}}, nil
+}
+
+// busy reports whether policy refuses opening f again. It must be called
+// with f.fs.fsMu held.
+func (f *PluginFile) busy(policy OpenPolicy) bool {
+	return f.opened > 0 && (f.mode || policy != OpenReplay)
+}
+
+// release is called when a handle on f is closed, and closes f once its
+// last handle is.
+func (f *PluginFile) release() error {
+	if f.meta != nil {
+		return nil
+	}
+	f.fs.fsMu.Lock()
+	f.handles--
+	last := f.handles == 0
+	f.fs.fsMu.Unlock()
+	if !last {
+		return nil
+	}
+	return f.Close()
+}
+
+// path returns the file's path in its PluginFS.
+func (i *PluginFile) path() string {
+	return streamsDir + "/" + i.id + "/" + i.name
+}
+
+// streamsDir is the PluginFS directory holding a directory of channels for
+// each stream.
+const streamsDir = "streams"
+
+// PluginFS is the filesystem mounted into plugins. Each stream is a
+// directory streams/<id> holding its named channels, such as in, out, err
+// and meta. The in and out channels are also exposed as in/<id> and
+// out/<id>. A stream is removed once the plugin has closed all of its
+// channels.
+type PluginFS struct {
+	config PluginFSConfig
+	fsMu   sync.Mutex
+	// streams maps stream IDs to their channels by name.
+	streams map[string]map[string]*PluginFile
+	// calls maps the IDs of streams that Runtime.Do is running a plugin
+	// against to their calls.
+	calls map[string]*streamCall
+}
+
+// streamCall is the calls in progress on a stream, and the outputs the
+// plugin closed during them, whose writers are only closed once the calls
+// finish so that a failure can still be reported to their readers.
+type streamCall struct {
+	n       int
+	outputs []*PluginFile
+}
+
+// NewPluginFS returns an empty PluginFS whose stream files can each be
+// opened once.
+func NewPluginFS() *PluginFS {
+	return NewPluginFSWithConfig(PluginFSConfig{})
+}
+
+// NewPluginFSWithConfig returns an empty PluginFS configured by config.
+func NewPluginFSWithConfig(config PluginFSConfig) *PluginFS {
+	return &PluginFS{
+		config:  config,
+		streams: make(map[string]map[string]*PluginFile),
+		calls:   make(map[string]*streamCall),
+	}
+}
+
+// Open implements fs.FS
+func (s *PluginFS) Open(name string) (fs.File, error) {
+	s.fsMu.Lock()
+	defer s.fsMu.Unlock()
+	if entries, ok := s.readDir(name); ok {
+		return &pluginDir{name: name, entries: entries}, nil
+	}
+	f, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.open(s.config.OpenPolicy, path.Base(name))
+}
+
+// lookup returns the stream file at name. It must be called with s.fsMu
+// held.
+func (s *PluginFS) lookup(name string) (*PluginFile, error) {
+	var id, channel string
+	switch parts := strings.Split(name, "/"); {
+	case len(parts) == 2 && (parts[0] == "in" || parts[0] == "out"):
+		id, channel = parts[1], parts[0]
+	case len(parts) == 3 && parts[0] == streamsDir:
+		id, channel = parts[1], parts[2]
+	case len(parts) == 2 && parts[0] == streamsDir:
+		return nil, fs.ErrNotExist // readDir lists the streams that exist.
+	default:
+		return nil, fs.ErrPermission
+	}
+	f, ok := s.streams[id][channel]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return f, nil
+}
+
+// ReadDir implements fs.ReadDirFS. The root lists the in, out and streams
+// directories. streams lists a directory for each stream, which lists its
+// channels that haven't been closed yet. in and out list the streams whose
+// channel of the same name hasn't been closed yet and can be opened under
+// the OpenPolicy, so that a plugin taking whatever streams are pending
+// doesn't list one another call has already opened.
+func (s *PluginFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	s.fsMu.Lock()
+	defer s.fsMu.Unlock()
+	entries, ok := s.readDir(name)
+	if !ok {
+		if _, err := s.lookup(name); err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return entries, nil
+}
+
+// readDir returns the sorted entries of the directory name, or false if name
+// isn't a directory. It must be called with s.fsMu held.
+func (s *PluginFS) readDir(name string) ([]fs.DirEntry, bool) {
+	var entries []fs.DirEntry
+	switch parts := strings.Split(name, "/"); {
+	case name == ".":
+		return []fs.DirEntry{
+			fs.FileInfoToDirEntry(dirInfo("in")),
+			fs.FileInfoToDirEntry(dirInfo("out")),
+			fs.FileInfoToDirEntry(dirInfo(streamsDir)),
+		}, true
+	case name == "in" || name == "out":
+		for id, channels := range s.streams {
+			if f, ok := channels[name]; ok && !f.closed && !f.busy(s.config.OpenPolicy) {
+				entries = append(entries, fs.FileInfoToDirEntry(renamedInfo{f, id}))
+			}
+		}
+	case name == streamsDir:
+		for id := range s.streams {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(streamsDir+"/"+id)))
+		}
+	case len(parts) == 2 && parts[0] == streamsDir:
+		channels, ok := s.streams[parts[1]]
+		if !ok {
+			return nil, false
+		}
+		for _, f := range channels {
+			if !f.closed {
+				entries = append(entries, fs.FileInfoToDirEntry(f))
+			}
+		}
+	default:
+		return nil, false
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, true
+}
+
+// Register exposes a stream to plugins under id, with inFile as its in
+// channel and outFile as its out channel. It returns fs.ErrExist if id is
+// already registered.
+func (s *PluginFS) Register(id string, inFile, outFile *PluginFile) error {
+	return s.RegisterChannels(id, map[string]*PluginFile{"in": inFile, "out": outFile}, nil)
+}
+
+// RegisterChannels exposes a stream to plugins under id with any number of
+// named channels, each an input from NewInFile or an output from
+// NewOutFile. It returns fs.ErrExist if id is already registered, and
+// fs.ErrInvalid if id or a channel name isn't a single path element, an
+// attribute is malformed, or a channel is named meta while attrs isn't
+// empty.
+//
+// If attrs isn't empty, the plugin can read them, such as a content type or
+// size hint, from the stream's meta channel as key=value lines sorted by
+// key. Keys can't be empty or contain '=' or newlines, and values can't
+// contain newlines.
+func (s *PluginFS) RegisterChannels(id string, channels map[string]*PluginFile, attrs map[string]string) error {
+	if !validElem(id) {
+		return fs.ErrInvalid
+	}
+	for name := range channels {
+		if !validElem(name) {
+			return fs.ErrInvalid
+		}
+	}
+	var meta *PluginFile
+	if len(attrs) > 0 {
+		if _, ok := channels[metaChannel]; ok {
+			return fs.ErrInvalid
+		}
+		var err error
+		if meta, err = newMetaFile(attrs); err != nil {
+			return err
+		}
+	}
+
+	s.fsMu.Lock()
+	defer s.fsMu.Unlock()
+	if _, ok := s.streams[id]; ok {
+		return fs.ErrExist
+	}
+	stream := make(map[string]*PluginFile, len(channels)+1)
+	for name, f := range channels {
+		f.fs, f.id, f.name = s, id, name
+		stream[name] = f
+	}
+	if meta != nil {
+		meta.fs, meta.id = s, id
+		stream[metaChannel] = meta
+	}
+	s.streams[id] = stream
+	return nil
+}
+
+// Unregister removes the stream registered under id without closing its
+// files. It returns fs.ErrNotExist if id isn't registered.
+func (s *PluginFS) Unregister(id string) error {
+	s.fsMu.Lock()
+	defer s.fsMu.Unlock()
+	if _, ok := s.streams[id]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.streams, id)
+	return nil
+}
+
+// Len returns the number of registered streams.
+func (s *PluginFS) Len() int {
+	s.fsMu.Lock()
+	defer s.fsMu.Unlock()
+	return len(s.streams)
+}
+
+// fileClosed marks f closed and removes its stream once all of its
+// channels are. The writer of an output is closed too, unless a call on its
+// stream is in progress, in which case finish closes it.
+func (s *PluginFS) fileClosed(f *PluginFile) {
+	s.fsMu.Lock()
+	if f.closed {
+		s.fsMu.Unlock()
+		return
+	}
+	f.closed = true
+	held := false
+	if c := s.calls[f.id]; c != nil && f.mode {
+		c.outputs = append(c.outputs, f)
+		held = true
+	}
+	s.removeClosed(f)
+	s.fsMu.Unlock()
+	if !held {
+		f.closeWriter(nil)
+	}
+}
+
+// removeClosed removes f's stream if all of its channels are closed. It
+// must be called with s.fsMu held.
+func (s *PluginFS) removeClosed(f *PluginFile) {
+	channels := s.streams[f.id]
+	if channels[f.name] != f {
+		return // Already removed, or replaced by a new registration.
+	}
+	for _, c := range channels {
+		if !c.closed && c.meta == nil {
+			return
+		}
+	}
+	delete(s.streams, f.id)
+}
+
+// begin records that a plugin is about to be called on stream id. Outputs
+// it closes keep their writers open until finish.
+func (s *PluginFS) begin(id string) {
+	s.fsMu.Lock()
+	defer s.fsMu.Unlock()
+	c := s.calls[id]
+	if c == nil {
+		c = &streamCall{}
+		s.calls[id] = c
+	}
+	c.n++
+}
+
+// finish closes the channels of stream id that are still open once a
+// plugin has returned from a call on it, or won't be called on it, and
+// then the writers of all of its outputs, including those the plugin
+// closed during the call, so that their readers don't wait forever. If the
+// call failed with err, the writers are closed with it. Handles still open
+// on the stream's channels fail from then on, so a plugin whose call timed
+// out can't go on reading or writing the stream.
+func (s *PluginFS) finish(id string, err error) {
+	s.fsMu.Lock()
+	var outputs []*PluginFile
+	if c := s.calls[id]; c != nil {
+		outputs, c.outputs = c.outputs, nil
+		if c.n--; c.n == 0 {
+			delete(s.calls, id)
+		}
+	}
+	if channels, ok := s.streams[id]; ok {
+		for _, f := range channels {
+			f.finished.Store(true)
+			if !f.closed && f.meta == nil {
+				f.closed = true
+				if f.mode {
+					outputs = append(outputs, f)
+				}
+			}
+		}
+		delete(s.streams, id)
+	}
+	s.fsMu.Unlock()
+	for _, f := range outputs {
+		f.closeWriter(err)
+	}
+}
+
+// validElem reports whether name is a single element of a path.
+func validElem(name string) bool {
+	return fs.ValidPath(name) && name != "." && !strings.Contains(name, "/")
+}
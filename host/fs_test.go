@@ -0,0 +1,137 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func newTestFS(t *testing.T, ids ...string) *PluginFS {
+	t.Helper()
+	pfs := NewPluginFS()
+	for _, id := range ids {
+		_, w := io.Pipe()
+		if err := pfs.Register(id, NewInFile(bytes.NewReader([]byte("input "+id))), NewOutFile(w)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pfs
+}
+
+func TestPluginFSStatName(t *testing.T) {
+	pfs := newTestFS(t, "a", "b")
+	for _, tc := range []struct{ path, name string }{
+		{"in/a", "a"},
+		{"out/a", "a"},
+		{"streams/b/in", "in"},
+		{"streams/b/out", "out"},
+	} {
+		f, err := pfs.Open(tc.path)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", tc.path, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("Stat %q: %v", tc.path, err)
+		}
+		if fi.Name() != tc.name {
+			t.Errorf("Stat %q: name %q, want %q", tc.path, fi.Name(), tc.name)
+		}
+	}
+}
+
+func TestPluginFSStatMatchesReadDir(t *testing.T) {
+	for _, dir := range []string{"in", "out", "streams/a"} {
+		// Opening a channel takes it, so each directory gets a fresh
+		// PluginFS.
+		pfs := newTestFS(t, "a")
+		entries, err := fs.ReadDir(pfs, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			f, err := pfs.Open(dir + "/" + e.Name())
+			if err != nil {
+				t.Fatalf("Open(%q): %v", dir+"/"+e.Name(), err)
+			}
+			fi, _ := f.Stat()
+			if fi.Name() != e.Name() {
+				t.Errorf("%s: Stat name %q, listed as %q", dir, fi.Name(), e.Name())
+			}
+		}
+	}
+}
+
+func TestPluginFSNotExist(t *testing.T) {
+	pfs := newTestFS(t, "a")
+	for _, name := range []string{"in/b", "out/b", "streams/b", "streams/b/in", "streams/a/err"} {
+		if _, err := pfs.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q): %v, want fs.ErrNotExist", name, err)
+		}
+		if _, err := pfs.ReadDir(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("ReadDir(%q): %v, want fs.ErrNotExist", name, err)
+		}
+	}
+	if _, err := pfs.Open("nope/a"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Open(%q): %v, want fs.ErrPermission", "nope/a", err)
+	}
+}
+
+func TestPluginFSReadDirHidesOpenInputs(t *testing.T) {
+	for _, tc := range []struct {
+		policy OpenPolicy
+		want   []string
+	}{
+		{OpenExclusive, []string{"b"}},
+		{OpenReplay, []string{"a", "b"}},
+	} {
+		pfs := NewPluginFSWithConfig(PluginFSConfig{OpenPolicy: tc.policy})
+		for _, id := range []string{"a", "b"} {
+			_, w := io.Pipe()
+			if err := pfs.Register(id, NewInFile(bytes.NewReader(nil)), NewOutFile(w)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := pfs.Open("in/a"); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := pfs.ReadDir("in")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Name())
+			if _, err := pfs.Open("in/" + e.Name()); err != nil {
+				t.Errorf("policy %d: opening listed input %s: %v", tc.policy, e.Name(), err)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("policy %d: in lists %v, want %v", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestPluginFileSize(t *testing.T) {
+	data := []byte("some input")
+	for _, tc := range []struct {
+		name string
+		r    io.Reader
+		want int64
+	}{
+		{"reader", bytes.NewReader(data), int64(len(data))},
+		{"buffer", bytes.NewBuffer(data), 0},
+		{"unknown", io.MultiReader(bytes.NewReader(data)), 0},
+	} {
+		f := NewInFile(tc.r)
+		if _, err := io.ReadFull(f, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Size(); got != tc.want {
+			t.Errorf("%s: Size %d after a partial read, want %d", tc.name, got, tc.want)
+		}
+	}
+}
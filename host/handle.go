@@ -0,0 +1,194 @@
+package host
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+var (
+	errWhence = errors.New("seek: invalid whence")
+	errOffset = errors.New("seek: negative position")
+)
+
+// inHandle is an input stream opened by a plugin. It has no Write method, so
+// WASI fd_write on it fails with EBADF.
+type inHandle struct {
+	f *PluginFile
+	r io.Reader
+	// info is f, renamed if it was opened as in/<id>.
+	info   fs.FileInfo
+	closed bool
+}
+
+// Stat implements fs.File
+func (h *inHandle) Stat() (fs.FileInfo, error) { return h.info, nil }
+
+// Read implements io.Reader
+func (h *inHandle) Read(p []byte) (int, error) {
+	if h.closed || h.f.finished.Load() {
+		return 0, &fs.PathError{Op: "read", Path: h.f.path(), Err: fs.ErrClosed}
+	}
+	return h.r.Read(p)
+}
+
+// Close implements fs.File
+func (h *inHandle) Close() error {
+	if h.closed {
+		return &fs.PathError{Op: "close", Path: h.f.path(), Err: fs.ErrClosed}
+	}
+	h.closed = true
+	return h.f.release()
+}
+
+// seekInHandle is an inHandle whose reader supports io.Seeker and
+// io.ReaderAt, so WASI fd_seek works on it. Handles on sources that don't
+// lack Seek, so fd_seek on them fails with EBADF.
+type seekInHandle struct {
+	inHandle
+}
+
+// Seek implements io.Seeker
+func (h *seekInHandle) Seek(offset int64, whence int) (int64, error) {
+	if h.closed || h.f.finished.Load() {
+		return 0, &fs.PathError{Op: "seek", Path: h.f.path(), Err: fs.ErrClosed}
+	}
+	return h.r.(io.Seeker).Seek(offset, whence)
+}
+
+// ReadAt implements io.ReaderAt
+func (h *seekInHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.closed || h.f.finished.Load() {
+		return 0, &fs.PathError{Op: "read", Path: h.f.path(), Err: fs.ErrClosed}
+	}
+	return h.r.(io.ReaderAt).ReadAt(p, off)
+}
+
+// outHandle is an output stream opened by a plugin. Reading it fails with
+// ErrWrongDirection, which WASI fd_read reports as EIO.
+type outHandle struct {
+	f      *PluginFile
+	info   fs.FileInfo
+	closed bool
+}
+
+// Stat implements fs.File
+func (h *outHandle) Stat() (fs.FileInfo, error) { return h.info, nil }
+
+// Read implements io.Reader
+func (h *outHandle) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: h.f.path(), Err: ErrWrongDirection}
+}
+
+// Write implements io.Writer
+func (h *outHandle) Write(p []byte) (int, error) {
+	if h.closed || h.f.finished.Load() {
+		return 0, &fs.PathError{Op: "write", Path: h.f.path(), Err: fs.ErrClosed}
+	}
+	return h.f.Write(p)
+}
+
+// Close implements fs.File
+func (h *outHandle) Close() error {
+	if h.closed {
+		return &fs.PathError{Op: "close", Path: h.f.path(), Err: fs.ErrClosed}
+	}
+	h.closed = true
+	return h.f.release()
+}
+
+// replayBuffer keeps everything read from an input so that every handle
+// opened under OpenReplay can read all of it.
+type replayBuffer struct {
+	mu  sync.Mutex
+	src io.Reader
+	buf []byte
+	err error
+}
+
+// readAt copies the input from off into p, reading more of the source when
+// off is past what has been buffered.
+func (b *replayBuffer) readAt(p []byte, off int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for off >= len(b.buf) && b.err == nil && len(p) > 0 {
+		chunk := make([]byte, len(p))
+		n, err := b.src.Read(chunk)
+		b.buf = append(b.buf, chunk[:n]...)
+		b.err = err
+	}
+	if off < len(b.buf) {
+		return copy(p, b.buf[off:]), nil
+	}
+	return 0, b.err
+}
+
+// size reads the rest of the source and returns the size of the input, or
+// the error that ended the source early.
+func (b *replayBuffer) size() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.err == nil {
+		chunk := make([]byte, 32<<10)
+		n, err := b.src.Read(chunk)
+		b.buf = append(b.buf, chunk[:n]...)
+		b.err = err
+	}
+	if b.err != io.EOF {
+		return 0, b.err
+	}
+	return int64(len(b.buf)), nil
+}
+
+// replayReader reads a replayBuffer from the start.
+type replayReader struct {
+	buf *replayBuffer
+	off int
+}
+
+// Read implements io.Reader
+func (r *replayReader) Read(p []byte) (int, error) {
+	n, err := r.buf.readAt(p, r.off)
+	r.off += n
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking relative to the end reads the rest of
+// the input into the buffer.
+func (r *replayReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(r.off)
+	case io.SeekEnd:
+		size, err := r.buf.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errOffset
+	}
+	r.off = int(offset)
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (r *replayReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errOffset
+	}
+	var n int
+	for n < len(p) {
+		c, err := r.buf.readAt(p[n:], int(off)+n)
+		n += c
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,127 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/iotest"
+)
+
+// openReplay registers src as the input of stream a in a PluginFS using
+// OpenReplay and opens it n times.
+func openReplay(t *testing.T, src io.Reader, n int) (*PluginFS, []fs.File) {
+	t.Helper()
+	pfs := NewPluginFSWithConfig(PluginFSConfig{OpenPolicy: OpenReplay})
+	_, w := io.Pipe()
+	if err := pfs.Register("a", NewInFile(src), NewOutFile(w)); err != nil {
+		t.Fatal(err)
+	}
+	files := make([]fs.File, n)
+	for i := range files {
+		f, err := pfs.Open("in/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = f
+	}
+	return pfs, files
+}
+
+func TestReplayInterleaved(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	// OneByteReader hides Seek, so only the replay buffer can rewind.
+	pfs, files := openReplay(t, iotest.OneByteReader(bytes.NewReader(data)), 2)
+
+	first := make([]byte, 10)
+	if _, err := io.ReadFull(files[0], first); err != nil {
+		t.Fatal(err)
+	}
+	second, err := io.ReadAll(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(first, rest...); !bytes.Equal(got, data) {
+		t.Errorf("first handle read %q, want %q", got, data)
+	}
+	if !bytes.Equal(second, data) {
+		t.Errorf("second handle read %q, want %q", second, data)
+	}
+
+	files[0].Close()
+	if entries, _ := fs.ReadDir(pfs, "in"); len(entries) != 1 {
+		t.Fatal("input closed while a handle is still open")
+	}
+	files[1].Close()
+	if entries, _ := fs.ReadDir(pfs, "in"); len(entries) != 0 {
+		t.Errorf("input still listed after its last handle closed")
+	}
+}
+
+func TestReplaySeek(t *testing.T) {
+	data := []byte("0123456789")
+	_, files := openReplay(t, iotest.OneByteReader(bytes.NewReader(data)), 1)
+	f := files[0].(io.ReadSeeker)
+
+	if pos, err := f.Seek(-3, io.SeekEnd); err != nil || pos != 7 {
+		t.Fatalf("Seek end: %d, %v, want 7", pos, err)
+	}
+	if got, _ := io.ReadAll(f); string(got) != "789" {
+		t.Errorf("read %q after seeking to 7, want 789", got)
+	}
+	p := make([]byte, 4)
+	if n, err := f.(io.ReaderAt).ReadAt(p, 2); n != 4 || err != nil || string(p) != "2345" {
+		t.Errorf("ReadAt 2: %q, %v, want 2345", p[:n], err)
+	}
+	if n, err := f.(io.ReaderAt).ReadAt(p, 8); n != 2 || err != io.EOF {
+		t.Errorf("ReadAt 8: %d, %v, want 2, io.EOF", n, err)
+	}
+	if _, err := f.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+}
+
+func TestReplaySourceError(t *testing.T) {
+	errBoom := errors.New("boom")
+	src := io.MultiReader(bytes.NewReader([]byte("abc")), iotest.ErrReader(errBoom))
+	_, files := openReplay(t, src, 2)
+
+	for i, f := range files {
+		got, err := io.ReadAll(f)
+		if string(got) != "abc" || !errors.Is(err, errBoom) {
+			t.Errorf("handle %d: %q, %v, want abc then %v", i, got, err, errBoom)
+		}
+	}
+	if _, err := files[0].(io.Seeker).Seek(0, io.SeekEnd); !errors.Is(err, errBoom) {
+		t.Errorf("Seek end: %v, want %v", err, errBoom)
+	}
+}
+
+func TestFinishFailsOpenHandles(t *testing.T) {
+	pfs := NewPluginFS()
+	_, w := io.Pipe()
+	if err := pfs.Register("a", NewInFile(bytes.NewReader([]byte("input"))), NewOutFile(w)); err != nil {
+		t.Fatal(err)
+	}
+	in, err := pfs.Open("in/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := pfs.Open("out/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfs.finish("a", ErrTimeout)
+
+	if _, err := in.Read(make([]byte, 1)); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("reading the input after finish: %v, want fs.ErrClosed", err)
+	}
+	if _, err := out.(io.Writer).Write([]byte("x")); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("writing the output after finish: %v, want fs.ErrClosed", err)
+	}
+}
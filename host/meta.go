@@ -0,0 +1,39 @@
+package host
+
+import (
+	"bytes"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metaChannel is the channel holding a stream's attributes.
+const metaChannel = "meta"
+
+// newMetaFile returns the meta channel of a stream with attrs. It lists one
+// key=value line per attribute, sorted by key. Unlike other channels, it can
+// be opened any number of times, each reading it from the start, and the
+// stream is removed without waiting for it to be closed.
+func newMetaFile(attrs map[string]string) (*PluginFile, error) {
+	keys := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		if k == "" || strings.ContainsAny(k, "=\n") || strings.Contains(v, "\n") {
+			return nil, fs.ErrInvalid
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		b.WriteString(k + "=" + attrs[k] + "\n")
+	}
+	meta := b.Bytes()
+	return &PluginFile{
+		name:    metaChannel,
+		reader:  bytes.NewReader(meta),
+		meta:    meta,
+		created: time.Now(),
+	}, nil
+}
@@ -0,0 +1,202 @@
+package host
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultPipeCapacity is the capacity of a pipe created by NewPipe with a
+// capacity of zero or less.
+const DefaultPipeCapacity = 64 << 10
+
+// PipeStats counts the traffic through a pipe and how long each side spent
+// blocked on the other: the writer on a full buffer, and the reader on an
+// empty one.
+type PipeStats struct {
+	Written       int64
+	Read          int64
+	Buffered      int
+	WriterBlocked time.Duration
+	ReaderBlocked time.Duration
+}
+
+// pipe is the buffer shared by a PipeReader and a PipeWriter.
+type pipe struct {
+	mu       sync.Mutex
+	readable sync.Cond
+	writable sync.Cond
+
+	// buf is a ring of n bytes starting at head.
+	buf  []byte
+	head int
+	n    int
+
+	// rerr and werr are set when the reader and writer are closed.
+	rerr error
+	werr error
+
+	stats PipeStats
+}
+
+// PipeReader is the read half of a pipe created by NewPipe.
+type PipeReader struct {
+	p *pipe
+}
+
+// PipeWriter is the write half of a pipe created by NewPipe.
+type PipeWriter struct {
+	p *pipe
+}
+
+// NewPipe creates a pipe like io.Pipe that buffers up to capacity bytes, so
+// writes only block while the buffer is full and reads while it is empty.
+// Use it as the writer of NewOutFile to keep a plugin from waiting on every
+// write.
+func NewPipe(capacity int) (*PipeReader, *PipeWriter) {
+	if capacity <= 0 {
+		capacity = DefaultPipeCapacity
+	}
+	p := &pipe{buf: make([]byte, capacity)}
+	p.readable.L = &p.mu
+	p.writable.L = &p.mu
+	return &PipeReader{p}, &PipeWriter{p}
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.n == 0 && p.rerr == nil && p.werr == nil && len(b) > 0 {
+		start := time.Now()
+		for p.n == 0 && p.rerr == nil && p.werr == nil {
+			p.readable.Wait()
+		}
+		p.stats.ReaderBlocked += time.Since(start)
+	}
+	if p.rerr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if p.n == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, p.werr
+	}
+
+	var n int
+	for n < len(b) && p.n > 0 {
+		end := p.head + p.n
+		if end > len(p.buf) {
+			end = len(p.buf)
+		}
+		c := copy(b[n:], p.buf[p.head:end])
+		p.head = (p.head + c) % len(p.buf)
+		p.n -= c
+		n += c
+	}
+	p.stats.Read += int64(n)
+	p.writable.Broadcast()
+	return n, nil
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int
+	for n < len(b) {
+		if p.n == len(p.buf) && p.rerr == nil && p.werr == nil {
+			start := time.Now()
+			for p.n == len(p.buf) && p.rerr == nil && p.werr == nil {
+				p.writable.Wait()
+			}
+			p.stats.WriterBlocked += time.Since(start)
+		}
+		if p.werr != nil {
+			return n, io.ErrClosedPipe
+		}
+		if p.rerr != nil {
+			return n, p.rerr
+		}
+
+		tail := (p.head + p.n) % len(p.buf)
+		end := len(p.buf)
+		if tail < p.head {
+			end = p.head
+		}
+		c := copy(p.buf[tail:end], b[n:])
+		p.n += c
+		n += c
+		p.stats.Written += int64(c)
+		p.readable.Broadcast()
+	}
+	return n, nil
+}
+
+func (p *pipe) closeRead(err error) {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rerr == nil {
+		p.rerr = err
+	}
+	p.readable.Broadcast()
+	p.writable.Broadcast()
+}
+
+func (p *pipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.werr == nil {
+		p.werr = err
+	}
+	p.readable.Broadcast()
+	p.writable.Broadcast()
+}
+
+func (p *pipe) snapshot() PipeStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Buffered = p.n
+	return stats
+}
+
+// Read implements io.Reader. It blocks until data is buffered or the writer
+// is closed, after which it returns the buffered data and then io.EOF, or the
+// error the writer was closed with.
+func (r *PipeReader) Read(b []byte) (int, error) { return r.p.read(b) }
+
+// Close implements io.Closer. Later writes fail with io.ErrClosedPipe.
+func (r *PipeReader) Close() error { return r.CloseWithError(nil) }
+
+// CloseWithError closes the reader. Later writes fail with err, or
+// io.ErrClosedPipe if err is nil.
+func (r *PipeReader) CloseWithError(err error) error {
+	r.p.closeRead(err)
+	return nil
+}
+
+// Stats returns the pipe's counters so far.
+func (r *PipeReader) Stats() PipeStats { return r.p.snapshot() }
+
+// Write implements io.Writer. It blocks until all of b is buffered or the
+// reader is closed.
+func (w *PipeWriter) Write(b []byte) (int, error) { return w.p.write(b) }
+
+// Close implements io.Closer. Reads return io.EOF once the buffer is drained.
+func (w *PipeWriter) Close() error { return w.CloseWithError(nil) }
+
+// CloseWithError closes the writer. Reads return err, or io.EOF if err is
+// nil, once the buffer is drained.
+func (w *PipeWriter) CloseWithError(err error) error {
+	w.p.closeWrite(err)
+	return nil
+}
+
+// Stats returns the pipe's counters so far.
+func (w *PipeWriter) Stats() PipeStats { return w.p.snapshot() }
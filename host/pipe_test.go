@@ -0,0 +1,108 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPipeRoundTrip(t *testing.T) {
+	// A capacity that doesn't divide the writes makes the ring wrap at
+	// every offset.
+	r, w := NewPipe(7)
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	go func() {
+		rnd := rand.New(rand.NewSource(2))
+		for b := data; len(b) > 0; {
+			n := 1 + rnd.Intn(20)
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := w.Write(b[:n]); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			b = b[n:]
+		}
+		w.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes differing from the %d written", len(got), len(data))
+	}
+	stats := r.Stats()
+	if stats.Written != int64(len(data)) || stats.Read != int64(len(data)) || stats.Buffered != 0 {
+		t.Errorf("stats %+v, want %d written and read", stats, len(data))
+	}
+}
+
+func TestPipeWriterCloseWithError(t *testing.T) {
+	r, w := NewPipe(16)
+	errBoom := errors.New("boom")
+	w.Write([]byte("abc"))
+	w.CloseWithError(errBoom)
+
+	got, err := io.ReadAll(r)
+	if string(got) != "abc" || err != errBoom {
+		t.Fatalf("ReadAll: %q, %v, want the buffered data then %v", got, err, errBoom)
+	}
+	if _, err := w.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write after close: %v, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestPipeReaderClose(t *testing.T) {
+	r, w := NewPipe(4)
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("more than four bytes"))
+		done <- err
+	}()
+
+	errBoom := errors.New("boom")
+	r.CloseWithError(errBoom)
+	if err := <-done; err != errBoom {
+		t.Errorf("blocked Write: %v, want %v", err, errBoom)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Read after close: %v, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestPipeBlockedCounters(t *testing.T) {
+	const wait = 10 * time.Millisecond
+	r, w := NewPipe(1)
+
+	read := make(chan struct{})
+	go func() {
+		r.Read(make([]byte, 1))
+		close(read)
+	}()
+	time.Sleep(wait)
+	w.Write([]byte("a"))
+	<-read
+	if got := r.Stats().ReaderBlocked; got < wait {
+		t.Errorf("ReaderBlocked %v, want at least %v", got, wait)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		w.Write([]byte("bc"))
+		close(written)
+	}()
+	time.Sleep(wait)
+	io.ReadFull(r, make([]byte, 2))
+	<-written
+	if got := w.Stats().WriterBlocked; got < wait {
+		t.Errorf("WriterBlocked %v, want at least %v", got, wait)
+	}
+}
@@ -0,0 +1,250 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// PoolConfig sets the size of a Pool and when it retires instances.
+type PoolConfig struct {
+	// MinSize instances are created up front and kept alive.
+	MinSize int
+	// MaxSize bounds the number of live instances. Get blocks while all of
+	// them are checked out. It defaults to MinSize, or 1.
+	MaxSize int
+	// MaxCalls retires an instance after it has served this many calls.
+	// Zero means no limit.
+	MaxCalls int
+	// MaxMemory retires an instance once its linear memory has grown past
+	// this many bytes. Zero means no limit.
+	MaxMemory uint32
+}
+
+// PoolStats is a snapshot of a Pool's instances.
+type PoolStats struct {
+	Idle    int
+	Live    int
+	Retired int
+	// Abandoned counts calls that timed out but whose guest is still
+	// running, as reported by Engine.Abandoned. Their instances are
+	// retired, so they aren't counted as Live.
+	Abandoned int
+}
+
+// Pool hands out plugin instances from an Engine and recycles them when
+// they are returned. Instances that trapped, exited or timed out are always
+// retired. It is safe for concurrent use.
+type Pool struct {
+	engine *Engine
+	config PoolConfig
+	// slots holds one token per instance that may be checked out.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	idle    []*Runtime
+	live    int
+	retired int
+	closed  bool
+	// drained is closed once the pool is closed and has no live instances.
+	drained     chan struct{}
+	drainedOnce sync.Once
+}
+
+// NewPool creates a Pool of instances of e and instantiates config.MinSize
+// of them.
+func NewPool(ctx context.Context, e *Engine, config PoolConfig) (*Pool, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = config.MinSize
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 1
+	}
+	if config.MinSize > config.MaxSize {
+		return nil, errors.New("pool MinSize is larger than MaxSize")
+	}
+	p := &Pool{
+		engine:  e,
+		config:  config,
+		slots:   make(chan struct{}, config.MaxSize),
+		drained: make(chan struct{}),
+	}
+	for i := 0; i < config.MaxSize; i++ {
+		p.slots <- struct{}{}
+	}
+	if err := p.fill(ctx); err != nil {
+		p.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// Get checks out an instance, instantiating one if none are idle. It blocks
+// until an instance is available or ctx ends. The instance must be given
+// back with Put.
+func (p *Pool) Get(ctx context.Context) (*Runtime, error) {
+	select {
+	case <-p.slots:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.slots <- struct{}{}
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		r := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return r, nil
+	}
+	p.live++
+	p.mu.Unlock()
+
+	r, err := p.engine.Instantiate(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.live--
+		p.mu.Unlock()
+		p.slots <- struct{}{}
+		return nil, err
+	}
+	return r, nil
+}
+
+// Put returns an instance checked out with Get, retiring it if it is broken
+// or past the pool's limits.
+func (p *Pool) Put(ctx context.Context, r *Runtime) {
+	p.mu.Lock()
+	if p.closed || p.retire(ctx, r) {
+		p.live--
+		p.retired++
+		p.checkDrained()
+		p.mu.Unlock()
+		r.Close(ctx)
+	} else {
+		p.idle = append(p.idle, r)
+		p.mu.Unlock()
+	}
+	p.slots <- struct{}{}
+	p.fill(ctx)
+}
+
+// Do runs the plugin against the stream registered under id on a pooled
+// instance, finishing the stream as Runtime.Do does even if no instance
+// could be checked out. If ctx ends first, Do returns a TimeoutError.
+func (p *Pool) Do(ctx context.Context, id string) error {
+	r, err := p.Get(ctx)
+	if err != nil {
+		return p.abort(ctx, id, err)
+	}
+	defer p.Put(ctx, r)
+	return r.Do(ctx, id)
+}
+
+// abort finishes the stream registered under id, which won't run because
+// checking out an instance for it failed with err. It returns err, as a
+// TimeoutError if ctx ended.
+func (p *Pool) abort(ctx context.Context, id string, err error) error {
+	if cerr := ctx.Err(); cerr != nil && errors.Is(err, cerr) {
+		err = &TimeoutError{ID: id, Err: cerr}
+	}
+	p.engine.finish(id, err)
+	return err
+}
+
+// Stats returns a snapshot of the pool's instances.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return PoolStats{
+		Idle:      len(p.idle),
+		Live:      p.live,
+		Retired:   p.retired,
+		Abandoned: p.engine.Abandoned(),
+	}
+}
+
+// Close closes idle instances. Instances still checked out are closed when
+// they are returned.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.live -= len(idle)
+	p.checkDrained()
+	p.mu.Unlock()
+
+	var err error
+	for _, r := range idle {
+		if e := r.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Drain closes the pool and waits until every checked out instance has been
+// returned and closed, or ctx ends.
+func (p *Pool) Drain(ctx context.Context) error {
+	if err := p.Close(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-p.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkDrained must be called with p.mu held.
+func (p *Pool) checkDrained() {
+	if p.closed && p.live == 0 {
+		p.drainedOnce.Do(func() { close(p.drained) })
+	}
+}
+
+// retire reports whether r should be closed instead of reused.
+func (p *Pool) retire(ctx context.Context, r *Runtime) bool {
+	switch {
+	case r.closed || r.broken:
+		return true
+	case p.config.MaxCalls > 0 && r.calls >= p.config.MaxCalls:
+		return true
+	case p.config.MaxMemory > 0 && r.Mod.Memory().Size() > p.config.MaxMemory:
+		return true
+	}
+	return false
+}
+
+// fill instantiates idle instances until MinSize are live.
+func (p *Pool) fill(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		if p.closed || p.live >= p.config.MinSize {
+			p.mu.Unlock()
+			return nil
+		}
+		p.live++
+		p.mu.Unlock()
+
+		r, err := p.engine.Instantiate(ctx)
+		p.mu.Lock()
+		if err != nil || p.closed {
+			p.live--
+			p.checkDrained()
+			p.mu.Unlock()
+			if r != nil {
+				r.Close(ctx)
+			}
+			return err
+		}
+		p.idle = append(p.idle, r)
+		p.mu.Unlock()
+	}
+}
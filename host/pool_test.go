@@ -0,0 +1,117 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestPoolDoFinishesStreamOnTimeout(t *testing.T) {
+	pfs := NewPluginFS()
+	r, w := NewPipe(0)
+	if err := pfs.Register("a", NewInFile(bytes.NewReader(nil)), NewOutFile(w)); err != nil {
+		t.Fatal(err)
+	}
+	// No instances are created without MinSize, so an Engine with only a
+	// filesystem will do.
+	p, err := NewPool(context.Background(), &Engine{streams: pfs}, PoolConfig{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-p.slots // Check out the only instance.
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = p.Do(ctx, "a")
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.ID != "a" || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Do: %v, want a TimeoutError for a", err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrTimeout) {
+		t.Errorf("reading output: %v, want ErrTimeout", err)
+	}
+	if n := pfs.Len(); n != 0 {
+		t.Errorf("%d streams left registered", n)
+	}
+}
+
+// newTestPool returns a pool of instances of a plugin whose do runs body.
+func newTestPool(t *testing.T, body []byte, config PoolConfig) *Pool {
+	t.Helper()
+	ctx := context.Background()
+	e, err := NewEngineWithConfig(ctx, testModule(pluginFuncs(body)...), NewPluginFS(), EngineConfig{Interpreter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close(ctx) })
+	p, err := NewPool(ctx, e, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close(ctx) })
+	return p
+}
+
+// doOnce runs a stream on an instance checked out of p and returns the
+// instance and the error from Do.
+func doOnce(t *testing.T, p *Pool) (*Runtime, error) {
+	t.Helper()
+	ctx := context.Background()
+	r, err := p.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Do(ctx, "a")
+	p.Put(ctx, r)
+	return r, err
+}
+
+func TestPoolRetirement(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   []byte
+		config PoolConfig
+		// calls is the number of calls an instance serves.
+		calls int
+	}{
+		{"max calls", nil, PoolConfig{MaxCalls: 3}, 3},
+		{"max memory", opGrowMemory, PoolConfig{MaxMemory: 2 << 16}, 2},
+		{"trap", opUnreachable, PoolConfig{}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPool(t, tc.body, tc.config)
+			first, _ := doOnce(t, p)
+			for i := 1; i < tc.calls; i++ {
+				if r, _ := doOnce(t, p); r != first {
+					t.Fatalf("call %d got a new instance", i+1)
+				}
+			}
+			if s := p.Stats(); s.Retired != 1 || s.Live != 0 || s.Idle != 0 {
+				t.Errorf("after %d calls: %+v, want the instance retired", tc.calls, s)
+			}
+			if r, _ := doOnce(t, p); r == first {
+				t.Error("retired instance reused")
+			}
+		})
+	}
+}
+
+func TestPoolTrapIsReported(t *testing.T) {
+	p := newTestPool(t, opUnreachable, PoolConfig{})
+	if _, err := doOnce(t, p); !errors.Is(err, ErrTrap) {
+		t.Errorf("Do: %v, want ErrTrap", err)
+	}
+}
+
+func TestPoolRefillsMinSize(t *testing.T) {
+	p := newTestPool(t, opUnreachable, PoolConfig{MinSize: 2, MaxSize: 3})
+	if s := p.Stats(); s.Live != 2 || s.Idle != 2 {
+		t.Fatalf("new pool: %+v, want 2 idle instances", s)
+	}
+	doOnce(t, p)
+	if s := p.Stats(); s.Retired != 1 || s.Live != 2 || s.Idle != 2 {
+		t.Errorf("after retiring an instance: %+v, want it replaced", s)
+	}
+}
@@ -0,0 +1,239 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownPlugin is returned for a plugin name or version that isn't
+// loaded in a Registry.
+var ErrUnknownPlugin = errors.New("unknown plugin")
+
+// PluginKey identifies a plugin in a Registry.
+type PluginKey struct {
+	Name    string
+	Version string
+}
+
+func (k PluginKey) String() string { return k.Name + "@" + k.Version }
+
+// Registry holds any number of named, versioned plugins, each with its own
+// Engine and Pool. All plugins share the same filesystem. It is safe for
+// concurrent use.
+type Registry struct {
+	fs     fs.FS
+	config EngineConfig
+	pool   PoolConfig
+
+	mu      sync.RWMutex
+	plugins map[PluginKey]*plugin
+	// versions lists the loaded versions of each plugin name, oldest
+	// first. The last one is used when a caller asks for no version.
+	versions map[string][]string
+}
+
+type plugin struct {
+	engine *Engine
+	pool   *Pool
+}
+
+// NewRegistry returns an empty Registry whose plugins are mounted on f,
+// compiled with config and pooled according to pool.
+func NewRegistry(f fs.FS, config EngineConfig, pool PoolConfig) *Registry {
+	return &Registry{
+		fs:       f,
+		config:   config,
+		pool:     pool,
+		plugins:  make(map[PluginKey]*plugin),
+		versions: make(map[string][]string),
+	}
+}
+
+// Load compiles wasm and adds it under name and version, which becomes the
+// latest version of name. It returns fs.ErrExist if the version is already
+// loaded.
+func (r *Registry) Load(ctx context.Context, name, version string, wasm []byte) error {
+	key := PluginKey{Name: name, Version: version}
+	r.mu.RLock()
+	_, ok := r.plugins[key]
+	r.mu.RUnlock()
+	if ok {
+		return fmt.Errorf("plugin %s: %w", key, fs.ErrExist)
+	}
+
+	e, err := NewEngineWithConfig(ctx, wasm, r.fs, r.config)
+	if err != nil {
+		return fmt.Errorf("plugin %s: %w", key, err)
+	}
+	p, err := NewPool(ctx, e, r.pool)
+	if err != nil {
+		e.Close(ctx)
+		return fmt.Errorf("plugin %s: %w", key, err)
+	}
+
+	r.mu.Lock()
+	if _, ok := r.plugins[key]; ok {
+		r.mu.Unlock()
+		p.Close(ctx)
+		e.Close(ctx)
+		return fmt.Errorf("plugin %s: %w", key, fs.ErrExist)
+	}
+	r.plugins[key] = &plugin{engine: e, pool: p}
+	r.versions[name] = append(r.versions[name], version)
+	r.mu.Unlock()
+	return nil
+}
+
+// LoadFile is like Load, reading the wasm from the file at path.
+func (r *Registry) LoadFile(ctx context.Context, name, version, path string) error {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return r.Load(ctx, name, version, wasm)
+}
+
+// Unload removes a plugin version so no new calls are routed to it. It waits
+// for calls already running on it to finish, or for ctx to end, before
+// closing its instances and engine.
+func (r *Registry) Unload(ctx context.Context, name, version string) error {
+	p, err := r.remove(name, version)
+	if err != nil {
+		return err
+	}
+	return p.close(ctx)
+}
+
+// remove removes a plugin version so no new calls are routed to it, and
+// returns it to be closed.
+func (r *Registry) remove(name, version string) (*plugin, error) {
+	key := PluginKey{Name: name, Version: version}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.plugins[key]
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %w", key, ErrUnknownPlugin)
+	}
+	delete(r.plugins, key)
+	r.removeVersion(name, version)
+	return p, nil
+}
+
+// Pool returns the pool of the plugin loaded under name and version, or of
+// the latest loaded version of name if version is empty.
+func (r *Registry) Pool(name, version string) (*Pool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, err := r.lookup(name, version)
+	if err != nil {
+		return nil, err
+	}
+	return p.pool, nil
+}
+
+// Do runs the plugin selected as by Pool against the stream registered
+// under id. If the selected version is unloaded before an instance is
+// checked out, the call is routed to the version now selected instead. The
+// stream is finished as by Pool.Do however the call fails.
+func (r *Registry) Do(ctx context.Context, name, version, id string) error {
+	for {
+		p, err := r.Pool(name, version)
+		if err != nil {
+			if streams, ok := r.fs.(*PluginFS); ok {
+				streams.finish(id, err)
+			}
+			return err
+		}
+		rt, err := p.Get(ctx)
+		if errors.Is(err, ErrClosed) {
+			continue
+		} else if err != nil {
+			return p.abort(ctx, id, err)
+		}
+		err = rt.Do(ctx, id)
+		p.Put(ctx, rt)
+		return err
+	}
+}
+
+// Plugins lists the loaded plugins, sorted by name and then load order.
+func (r *Registry) Plugins() []PluginKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.versions))
+	for name := range r.versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var keys []PluginKey
+	for _, name := range names {
+		for _, version := range r.versions[name] {
+			keys = append(keys, PluginKey{Name: name, Version: version})
+		}
+	}
+	return keys
+}
+
+// Close unloads every plugin, waiting for running calls as Unload does.
+func (r *Registry) Close(ctx context.Context) error {
+	r.mu.Lock()
+	plugins := r.plugins
+	r.plugins = make(map[PluginKey]*plugin)
+	r.versions = make(map[string][]string)
+	r.mu.Unlock()
+
+	var err error
+	for _, p := range plugins {
+		if e := p.close(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// lookup must be called with r.mu held.
+func (r *Registry) lookup(name, version string) (*plugin, error) {
+	if version == "" {
+		versions := r.versions[name]
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("plugin %s: %w", name, ErrUnknownPlugin)
+		}
+		version = versions[len(versions)-1]
+	}
+	key := PluginKey{Name: name, Version: version}
+	p, ok := r.plugins[key]
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %w", key, ErrUnknownPlugin)
+	}
+	return p, nil
+}
+
+// removeVersion must be called with r.mu held.
+func (r *Registry) removeVersion(name, version string) {
+	versions := r.versions[name]
+	for i, v := range versions {
+		if v == version {
+			versions = append(versions[:i:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(r.versions, name)
+	} else {
+		r.versions[name] = versions
+	}
+}
+
+func (p *plugin) close(ctx context.Context) error {
+	err := p.pool.Drain(ctx)
+	if e := p.engine.Close(ctx); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package host
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchSwitchBack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := testModule(pluginFuncs(nil)...)
+	b := testModule(pluginFuncs(opGrowMemory)...)
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(path, a, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry(NewPluginFS(), EngineConfig{Interpreter: true}, PoolConfig{MaxSize: 1})
+	defer r.Close(ctx)
+	reloads := make(chan PluginKey)
+	err := r.Watch(ctx, "p", path, time.Millisecond, func(key PluginKey, err error) {
+		if err != nil {
+			t.Errorf("reloading %s: %v", key, err)
+		}
+		reloads <- key
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wasm := range [][]byte{b, a} {
+		if err := os.WriteFile(path, wasm, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want := PluginKey{Name: "p", Version: testVersion(wasm)}
+		if key := <-reloads; key != want {
+			t.Fatalf("reloaded %s, want %s", key, want)
+		}
+		if got := r.Plugins(); !reflect.DeepEqual(got, []PluginKey{want}) {
+			t.Fatalf("loaded %v after reloading %s, want only it", got, want)
+		}
+	}
+}
+
+// testVersion returns the version Watch names wasm.
+func testVersion(wasm []byte) string {
+	sum := sha256.Sum256(wasm)
+	return hex.EncodeToString(sum[:6])
+}
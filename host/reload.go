@@ -0,0 +1,88 @@
+package host
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"time"
+)
+
+// Watch loads the wasm file at path as plugin name, then polls it every
+// interval until ctx ends. Whenever its contents change, the new build is
+// compiled in the background and loaded as a new version, so new calls are
+// routed to it, and the version it replaces is unloaded once the calls
+// running on it finish.
+//
+// Versions are named after the hash of the wasm. report, if not nil, is
+// called after every reload with the version loaded or the error that kept
+// it from loading. The last version loaded stays loaded after ctx ends.
+func (r *Registry) Watch(ctx context.Context, name, path string, interval time.Duration, report func(PluginKey, error)) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	version, err := r.loadVersion(ctx, name, path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			next, err := os.Stat(path)
+			if err != nil || (next.ModTime().Equal(fi.ModTime()) && next.Size() == fi.Size()) {
+				continue
+			}
+			fi = next
+
+			loaded, err := r.loadVersion(ctx, name, path)
+			if err != nil {
+				if report != nil {
+					report(PluginKey{Name: name, Version: loaded}, err)
+				}
+				continue
+			}
+			if loaded == version {
+				continue
+			}
+			// The replaced version is removed right away, so that
+			// switching back to it loads it again, and only drained in
+			// the background.
+			if p, err := r.remove(name, version); err == nil {
+				go p.close(context.Background())
+			}
+			version = loaded
+			if report != nil {
+				report(PluginKey{Name: name, Version: loaded}, nil)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadVersion loads the wasm at path as a version of name named after its
+// hash, unless that version is already loaded.
+func (r *Registry) loadVersion(ctx context.Context, name, path string) (string, error) {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(wasm)
+	version := hex.EncodeToString(sum[:6])
+
+	r.mu.RLock()
+	_, ok := r.plugins[PluginKey{Name: name, Version: version}]
+	r.mu.RUnlock()
+	if ok {
+		return version, nil
+	}
+	return version, r.Load(ctx, name, version, wasm)
+}
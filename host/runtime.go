@@ -0,0 +1,261 @@
+// Package host runs stream transform plugins compiled to WebAssembly.
+//
+// A plugin reads a stream from its in channel and writes the result to its
+// out channel, and any others the host registered, through a PluginFS,
+// either as WASI files under streams/<id> or through the stream host module
+// (see Transport). The host copies the stream ID into a buffer from the
+// plugin's my_malloc export, passes it to the do export, and hands the
+// buffer back with my_free once do returns. A non-zero status from do is
+// reported as a StreamError carrying the plugin's error_message. See
+// ABIVersion for how a plugin declares the version of this contract it
+// implements.
+//
+// Plugins can be WASI commands or reactors: whichever of _start and
+// _initialize they export runs when they are instantiated.
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// exitCodeAbandoned is the exit code a module is closed with when a call's
+// context ends before the guest returns.
+const exitCodeAbandoned = 124
+
+// Runtime is a single instantiated plugin. It is not safe for concurrent use.
+type Runtime struct {
+	R      wazero.Runtime
+	Mod    api.Module
+	malloc api.Function
+	free   api.Function
+	do     api.Function
+
+	errorMessage api.Function
+
+	// allocs maps guest buffers from my_malloc that haven't been given
+	// back with my_free to their size.
+	allocs map[uint32]uint32
+
+	engine *Engine
+	// ownsEngine is set when the Runtime was created by New and closing it
+	// releases the engine too.
+	ownsEngine bool
+	closed     bool
+	// abandoned is set when a call outlived its context and may still be
+	// running, so the Runtime's state must not be touched.
+	abandoned bool
+	// broken is set once a call traps or exits, after which the instance's
+	// state can't be trusted.
+	broken bool
+	calls  int
+}
+
+// New compiles and instantiates the plugin wasm with f mounted as its
+// filesystem. Use an Engine to run several instances of the same plugin.
+func New(ctx context.Context, wasm []byte, f fs.FS) (*Runtime, error) {
+	e, err := NewEngine(ctx, wasm, f)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.Instantiate(ctx)
+	if err != nil {
+		e.Close(ctx)
+		return nil, err
+	}
+	r.ownsEngine = true
+	return r, nil
+}
+
+// Do runs the plugin against the stream registered under id. It returns
+// fs.ErrInvalid without calling the plugin if id couldn't be registered.
+//
+// If ctx is cancelled or its deadline passes before the plugin returns, Do
+// closes the plugin's module and returns a TimeoutError without waiting for
+// it. The Runtime is unusable afterwards. wazero stops the guest the next
+// time it calls a function or loops, and finishing the stream fails its
+// further reads and writes on it, but a guest blocked in a host call, such
+// as a read from an input with no data yet, runs on until that call
+// returns. Engine.Abandoned counts the calls that haven't stopped yet.
+//
+// When the engine's filesystem is a PluginFS, Do finishes the stream once
+// the plugin returns, even if the Runtime was already closed: it closes the
+// channels the plugin left open, and only then the writers of the stream's
+// outputs, including those the plugin closed itself. If Do fails, writers
+// with a CloseWithError method, like those from io.Pipe and NewPipe, are
+// closed with its error, so their readers see it instead of hanging or
+// taking a truncated stream as complete.
+func (r *Runtime) Do(ctx context.Context, id string) error {
+	if !validElem(id) {
+		return fmt.Errorf("stream %q: %w", id, fs.ErrInvalid)
+	}
+	if r.closed {
+		r.engine.finish(id, ErrClosed)
+		return ErrClosed
+	}
+	r.engine.begin(id)
+	err := r.run(ctx, id)
+	r.engine.finish(id, err)
+	return err
+}
+
+func (r *Runtime) run(ctx context.Context, id string) error {
+	r.calls++
+	if ctx.Done() == nil {
+		return r.result(r.call(ctx, id))
+	}
+	if err := ctx.Err(); err != nil {
+		return &TimeoutError{ID: id, Err: err}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- r.call(ctx, id) }()
+	select {
+	case err := <-done:
+		if cerr := ctx.Err(); cerr != nil && errors.Is(err, ErrExit) {
+			// wazero closed the module as ctx ended.
+			r.closed = true
+			return &TimeoutError{ID: id, Err: cerr}
+		}
+		return r.result(err)
+	case <-ctx.Done():
+		r.closed = true
+		r.abandoned = true
+		r.engine.abandon(done)
+		r.Mod.CloseWithExitCode(context.Background(), exitCodeAbandoned)
+		return &TimeoutError{ID: id, Err: ctx.Err()}
+	}
+}
+
+// result records whether err left the instance broken and returns it.
+func (r *Runtime) result(err error) error {
+	if errors.Is(err, ErrTrap) || errors.Is(err, ErrExit) {
+		r.broken = true
+	}
+	return err
+}
+
+func (r *Runtime) call(ctx context.Context, id string) error {
+	if r.engine.transport == TransportHost {
+		h := &handles{}
+		ctx = context.WithValue(ctx, handlesKey{}, h)
+		defer h.closeAll()
+	}
+	ptr, err := r.alloc(ctx, []byte(id))
+	if err != nil {
+		return err
+	}
+	results, err := r.do.Call(ctx, uint64(ptr), uint64(len(id)))
+	if err != nil {
+		return callError("do", err)
+	}
+	if err = r.release(ctx, ptr); err != nil {
+		return err
+	}
+	if status := uint32(results[0]); status != 0 {
+		msg, err := r.lastError(ctx)
+		if err != nil {
+			return err
+		}
+		return &StreamError{ID: id, Status: status, Message: msg}
+	}
+	return nil
+}
+
+// lastError returns the message the plugin left for its last failed do.
+func (r *Runtime) lastError(ctx context.Context) (string, error) {
+	results, err := r.errorMessage.Call(ctx)
+	if err != nil {
+		return "", callError("error_message", err)
+	}
+	ptr, size := uint32(results[0]>>32), uint32(results[0])
+	if size == 0 {
+		return "", nil
+	}
+	r.allocs[ptr] = size
+
+	b, ok := r.Mod.Memory().Read(ptr, size)
+	if !ok {
+		err := &MemoryError{Offset: ptr, Length: size, Size: r.Mod.Memory().Size()}
+		r.release(ctx, ptr)
+		return "", err
+	}
+	msg := string(b)
+	return msg, r.release(ctx, ptr)
+}
+
+// alloc copies b into a buffer from my_malloc. The buffer is tracked until
+// it is given back with release.
+func (r *Runtime) alloc(ctx context.Context, b []byte) (uint32, error) {
+	results, err := r.malloc.Call(ctx, uint64(len(b)))
+	if err != nil {
+		return 0, callError("my_malloc", err)
+	}
+	ptr := uint32(results[0])
+	r.allocs[ptr] = uint32(len(b))
+
+	if !r.Mod.Memory().Write(ptr, b) {
+		err := &MemoryError{
+			Offset: ptr,
+			Length: uint32(len(b)),
+			Size:   r.Mod.Memory().Size(),
+		}
+		r.release(ctx, ptr)
+		return 0, err
+	}
+	return ptr, nil
+}
+
+// release gives a buffer from alloc back to the guest with my_free.
+func (r *Runtime) release(ctx context.Context, ptr uint32) error {
+	if _, err := r.free.Call(ctx, uint64(ptr)); err != nil {
+		return callError("my_free", err)
+	}
+	delete(r.allocs, ptr)
+	return nil
+}
+
+// Allocation is a guest buffer handed out by my_malloc.
+type Allocation struct {
+	Ptr  uint32
+	Size uint32
+}
+
+// Unreleased returns the buffers the host allocated in the guest that
+// haven't been given back with my_free, which happens when a call fails
+// part way through.
+func (r *Runtime) Unreleased() []Allocation {
+	if r.abandoned {
+		return nil
+	}
+	allocs := make([]Allocation, 0, len(r.allocs))
+	for ptr, size := range r.allocs {
+		allocs = append(allocs, Allocation{Ptr: ptr, Size: size})
+	}
+	return allocs
+}
+
+// Close releases the plugin instance, and its engine if it was created by
+// New.
+//
+// Buffers still unreleased are added to the engine's Unreleased count.
+func (r *Runtime) Close(ctx context.Context) error {
+	r.closed = true
+	if !r.abandoned && len(r.allocs) > 0 {
+		atomic.AddUint64(&r.engine.unreleased, uint64(len(r.allocs)))
+		r.allocs = nil
+	}
+	err := r.Mod.Close(ctx)
+	if r.ownsEngine {
+		if e := r.engine.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// benchPlugin returns the plugin the bench runs, which copies each stream's
+// input to its output.
+func benchPlugin(t *testing.T) []byte {
+	t.Helper()
+	wasm, err := os.ReadFile("../cmd/bench/plugin.wasm")
+	if err != nil {
+		t.Skip(err)
+	}
+	return wasm
+}
+
+func TestDoFailureReachesOutputReader(t *testing.T) {
+	wasm := benchPlugin(t)
+	for name, transport := range map[string]Transport{"file": TransportFile, "host": TransportHost} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			pfs := NewPluginFS()
+			e, err := NewEngineWithConfig(ctx, wasm, pfs, EngineConfig{Transport: transport})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close(ctx)
+			r, err := e.Instantiate(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close(ctx)
+
+			in := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("disk on fire")))
+			out, w := NewPipe(0)
+			if err := pfs.Register("a", NewInFile(in), NewOutFile(w)); err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() { done <- r.Do(ctx, "a") }()
+
+			_, readErr := io.ReadAll(out)
+			err = <-done
+			var streamErr *StreamError
+			if !errors.As(err, &streamErr) || streamErr.Status != 3 {
+				t.Fatalf("Do: %v, want a StreamError with status 3", err)
+			}
+			if readErr != err {
+				t.Errorf("reading output: %v, want %v", readErr, err)
+			}
+		})
+	}
+}
+
+// testFunc is a function exported by a module from testModule.
+type testFunc struct {
+	name    string
+	params  []api.ValueType
+	results []api.ValueType
+	// body is the function's instructions, without its final end.
+	body []byte
+}
+
+// Instructions for testFunc bodies.
+var (
+	opUnreachable = []byte{0x00}
+	opLoopForever = []byte{0x03, 0x40, 0x0c, 0x00, 0x0b} // loop br 0 end
+	opI32Zero     = []byte{0x41, 0x00}
+	opI64Zero     = []byte{0x42, 0x00}
+	// opGrowMemory grows memory by a page.
+	opGrowMemory = []byte{0x41, 0x01, 0x40, 0x00, 0x1a}
+)
+
+var (
+	i32 = api.ValueTypeI32
+	i64 = api.ValueTypeI64
+)
+
+// pluginFuncs returns the exports of a plugin that does nothing, with do
+// running body before returning status 0.
+func pluginFuncs(do []byte) []testFunc {
+	return []testFunc{
+		{name: abiVersionPrefix + strconv.Itoa(ABIVersion)},
+		{name: "my_malloc", params: []api.ValueType{i32}, results: []api.ValueType{i32}, body: opI32Zero},
+		{name: "my_free", params: []api.ValueType{i32}},
+		{name: "do", params: []api.ValueType{i32, i32}, results: []api.ValueType{i32}, body: append(do, opI32Zero...)},
+		{name: "error_message", results: []api.ValueType{i64}, body: opI64Zero},
+	}
+}
+
+// testModule encodes a module with a page of memory, exported as memory,
+// and funcs.
+func testModule(funcs ...testFunc) []byte {
+	var types, decls, exports, code []byte
+	for i, f := range funcs {
+		types = append(types, 0x60)
+		types = appendVec(types, len(f.params), f.params)
+		types = appendVec(types, len(f.results), f.results)
+		decls = leb128(decls, uint32(i))
+		exports = appendVec(exports, len(f.name), []byte(f.name))
+		exports = leb128(append(exports, 0x00), uint32(i))
+		body := append(append([]byte{0x00}, f.body...), 0x0b) // no locals
+		code = appendVec(code, len(body), body)
+	}
+	exports = appendVec(exports, len("memory"), []byte("memory"))
+	exports = append(exports, 0x02, 0x00)
+
+	m := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	m = appendSection(m, 1, len(funcs), types)
+	m = appendSection(m, 3, len(funcs), decls)
+	m = appendSection(m, 5, 1, []byte{0x00, 0x01}) // min 1 page, no max
+	m = appendSection(m, 7, len(funcs)+1, exports)
+	m = appendSection(m, 10, len(funcs), code)
+	return m
+}
+
+func appendSection(b []byte, id byte, n int, contents []byte) []byte {
+	vec := appendVec(nil, n, contents)
+	return appendVec(append(b, id), len(vec), vec)
+}
+
+// appendVec appends n, then contents.
+func appendVec(b []byte, n int, contents []byte) []byte {
+	return append(leb128(b, uint32(n)), contents...)
+}
+
+func leb128(b []byte, v uint32) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func TestDoTimeoutStopsGuest(t *testing.T) {
+	ctx := context.Background()
+	for name, interpreter := range map[string]bool{"compiler": false, "interpreter": true} {
+		t.Run(name, func(t *testing.T) {
+			pfs := NewPluginFS()
+			e, err := NewEngineWithConfig(ctx, testModule(pluginFuncs(opLoopForever)...), pfs, EngineConfig{Interpreter: interpreter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close(ctx)
+			r, err := e.Instantiate(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close(ctx)
+			out, w := NewPipe(0)
+			if err := pfs.Register("a", NewInFile(bytes.NewReader(nil)), NewOutFile(w)); err != nil {
+				t.Fatal(err)
+			}
+
+			callCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			err = r.Do(callCtx, "a")
+			if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Do: %v, want a TimeoutError for the deadline", err)
+			}
+			if _, rerr := io.ReadAll(out); rerr != err {
+				t.Errorf("reading output: %v, want %v", rerr, err)
+			}
+			if err := r.Do(ctx, "a"); err != ErrClosed {
+				t.Errorf("Do after a timeout: %v, want ErrClosed", err)
+			}
+
+			// The guest loops forever, so it only stops if wazero stops it.
+			for deadline := time.Now().Add(5 * time.Second); e.Abandoned() > 0; {
+				if time.Now().After(deadline) {
+					t.Fatal("timed out guest still running")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestDoInvalidID(t *testing.T) {
+	ctx := context.Background()
+	pfs := NewPluginFS()
+	r, err := New(ctx, benchPlugin(t), pfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close(ctx)
+
+	for _, id := range []string{"", ".", "a/b"} {
+		if err := r.Do(ctx, id); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Do(%q): %v, want fs.ErrInvalid", id, err)
+		}
+	}
+	// The plugin must cope with an empty buffer too.
+	if _, err := r.alloc(ctx, nil); err != nil {
+		t.Errorf("allocating an empty buffer: %v", err)
+	}
+
+	out, w := NewPipe(0)
+	if err := pfs.Register("a", NewInFile(bytes.NewReader([]byte("input"))), NewOutFile(w)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.Do(ctx, "a") }()
+	if b, err := io.ReadAll(out); err != nil || string(b) != "input" {
+		t.Errorf("output %q, %v, want %q", b, err, "input")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Do after invalid IDs: %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Transport selects how plugins move stream data.
+type Transport int
+
+const (
+	// TransportFile has plugins open streams as WASI files in/<id> and
+	// out/<id> on the engine's filesystem.
+	TransportFile Transport = iota
+	// TransportHost has plugins open streams through the stream host
+	// module, which copies directly between the streams registered in a
+	// PluginFS and guest memory, skipping WASI path lookups and file
+	// descriptor bookkeeping.
+	TransportHost
+)
+
+// streamModule is the name of the host module plugins import to use
+// TransportHost. It is always instantiated, so plugins can fall back to
+// files when its open function returns errnoNosys.
+const streamModule = "stream"
+
+// Channels a plugin passes to stream.open. Other channels are opened by name
+// with stream.open_channel.
+const (
+	channelIn uint32 = iota
+	channelOut
+)
+
+// Negative results of the stream host functions. They match the WASI errno
+// values for the same conditions.
+const (
+	errnoBadf   int32 = -8
+	errnoBusy   int32 = -10
+	errnoFault  int32 = -21
+	errnoIo     int32 = -29
+	errnoInval  int32 = -28
+	errnoNoent  int32 = -44
+	errnoNosys  int32 = -52
+	errnoNotdir int32 = -54
+	errnoSpipe  int32 = -70
+)
+
+// handlesKey is the context key of the *handles for the call in progress.
+type handlesKey struct{}
+
+// handles are the streams a plugin opened through the stream module during
+// one call, indexed by handle.
+type handles struct {
+	files []fs.File
+}
+
+func (h *handles) get(handle uint32) fs.File {
+	if int(handle) >= len(h.files) {
+		return nil
+	}
+	return h.files[handle]
+}
+
+// closeAll closes the streams the plugin left open when its call returned.
+func (h *handles) closeAll() {
+	for i, f := range h.files {
+		if f != nil {
+			f.Close()
+			h.files[i] = nil
+		}
+	}
+}
+
+// streamHost implements the stream host module for an engine.
+type streamHost struct {
+	fs        *PluginFS
+	transport Transport
+}
+
+// instantiateStream instantiates the stream host module in r. fsys is nil
+// unless the engine's filesystem is a PluginFS. Only list works under
+// TransportFile.
+func instantiateStream(ctx context.Context, r wazero.Runtime, fsys *PluginFS, transport Transport) error {
+	h := &streamHost{fs: fsys, transport: transport}
+	_, err := r.NewHostModuleBuilder(streamModule).
+		NewFunctionBuilder().WithFunc(h.open).WithParameterNames("id", "id_len", "channel").Export("open").
+		NewFunctionBuilder().WithFunc(h.openChannel).WithParameterNames("id", "id_len", "name", "name_len").Export("open_channel").
+		NewFunctionBuilder().WithFunc(h.read).WithParameterNames("handle", "buf", "buf_len").Export("read").
+		NewFunctionBuilder().WithFunc(h.readAt).WithParameterNames("handle", "buf", "buf_len", "offset").Export("read_at").
+		NewFunctionBuilder().WithFunc(h.seek).WithParameterNames("handle", "offset", "whence").Export("seek").
+		NewFunctionBuilder().WithFunc(h.write).WithParameterNames("handle", "buf", "buf_len").Export("write").
+		NewFunctionBuilder().WithFunc(h.close).WithParameterNames("handle").Export("close").
+		NewFunctionBuilder().WithFunc(h.list).WithParameterNames("dir", "dir_len", "buf", "buf_len").Export("list").
+		Instantiate(ctx)
+	return err
+}
+
+// open returns a handle to the given channel of the stream id, or a negative
+// errno. It returns errnoNosys unless the engine uses TransportHost.
+func (s *streamHost) open(ctx context.Context, m api.Module, id, idLen, channel uint32) int32 {
+	var name string
+	switch channel {
+	case channelIn:
+		name = "in"
+	case channelOut:
+		name = "out"
+	default:
+		return errnoInval
+	}
+	return s.openName(ctx, m, id, idLen, name)
+}
+
+// openChannel is like open, for the channel of the stream id named by the
+// nameLen bytes at name.
+func (s *streamHost) openChannel(ctx context.Context, m api.Module, id, idLen, name, nameLen uint32) int32 {
+	if s.transport != TransportHost {
+		return errnoNosys
+	}
+	b, ok := m.Memory().Read(name, nameLen)
+	if !ok {
+		return errnoFault
+	}
+	return s.openName(ctx, m, id, idLen, string(b))
+}
+
+// openName opens the named channel of the stream id.
+func (s *streamHost) openName(ctx context.Context, m api.Module, id, idLen uint32, name string) int32 {
+	h, ok := ctx.Value(handlesKey{}).(*handles)
+	if s.transport != TransportHost || !ok {
+		return errnoNosys
+	}
+	b, ok := m.Memory().Read(id, idLen)
+	if !ok {
+		return errnoFault
+	}
+	if !validElem(string(b)) || !validElem(name) {
+		return errnoInval
+	}
+
+	f, err := s.fs.Open(streamsDir + "/" + string(b) + "/" + name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errnoNoent
+	} else if errors.Is(err, ErrBusy) {
+		return errnoBusy
+	} else if err != nil {
+		return errnoIo
+	}
+	h.files = append(h.files, f)
+	return int32(len(h.files) - 1)
+}
+
+// read reads up to bufLen bytes into buf, or math.MaxInt32 if bufLen is
+// larger, returning the count, 0 at the end of the stream, or a negative
+// errno. Reading an output fails with
+// errnoBadf.
+func (s *streamHost) read(ctx context.Context, m api.Module, handle, buf, bufLen uint32) int32 {
+	var f io.Reader
+	switch h := s.file(ctx, handle).(type) {
+	case *inHandle:
+		f = h
+	case *seekInHandle:
+		f = h
+	default:
+		return errnoBadf
+	}
+	b, ok := m.Memory().Read(buf, clampLen(bufLen))
+	if !ok {
+		return errnoFault
+	}
+	n, err := f.Read(b)
+	if n == 0 && err != nil && err != io.EOF {
+		return errnoIo
+	}
+	return int32(n)
+}
+
+// readAt is like read, reading from offset without moving the handle's
+// position. It fails with errnoSpipe unless the input is seekable.
+func (s *streamHost) readAt(ctx context.Context, m api.Module, handle, buf, bufLen uint32, offset uint64) int32 {
+	f, errno := s.seekable(ctx, handle)
+	if f == nil {
+		return errno
+	}
+	b, ok := m.Memory().Read(buf, clampLen(bufLen))
+	if !ok {
+		return errnoFault
+	}
+	n, err := f.ReadAt(b, int64(offset))
+	if n == 0 && err != nil && err != io.EOF {
+		return errnoIo
+	}
+	return int32(n)
+}
+
+// seek sets the position of a handle like io.Seeker, returning the new
+// position or a negative errno. It fails with errnoSpipe unless the input is
+// seekable.
+func (s *streamHost) seek(ctx context.Context, handle uint32, offset int64, whence uint32) int64 {
+	f, errno := s.seekable(ctx, handle)
+	if f == nil {
+		return int64(errno)
+	}
+	if whence > io.SeekEnd {
+		return int64(errnoInval)
+	}
+	n, err := f.Seek(offset, int(whence))
+	if err != nil {
+		return int64(errnoInval)
+	}
+	return n
+}
+
+// write writes bufLen bytes from buf, or math.MaxInt32 if bufLen is larger,
+// returning the count or a negative errno. Writing an input fails with errnoBadf.
+func (s *streamHost) write(ctx context.Context, m api.Module, handle, buf, bufLen uint32) int32 {
+	w, ok := s.file(ctx, handle).(*outHandle)
+	if !ok {
+		return errnoBadf
+	}
+	b, ok := m.Memory().Read(buf, clampLen(bufLen))
+	if !ok {
+		return errnoFault
+	}
+	n, err := w.Write(b)
+	if err != nil {
+		return errnoIo
+	}
+	return int32(n)
+}
+
+// clampLen limits the length of a buffer passed to read, read_at or write
+// so that the count they return fits in an int32.
+func clampLen(n uint32) uint32 {
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return n
+}
+
+// close closes a handle, returning 0 or a negative errno.
+func (s *streamHost) close(ctx context.Context, handle uint32) int32 {
+	h, ok := ctx.Value(handlesKey{}).(*handles)
+	if !ok {
+		return errnoBadf
+	}
+	f := h.get(handle)
+	if f == nil {
+		return errnoBadf
+	}
+	h.files[handle] = nil
+	if err := f.Close(); err != nil {
+		return errnoIo
+	}
+	return 0
+}
+
+// seekable returns the seekable input open as handle, or nil and a negative
+// errno.
+func (s *streamHost) seekable(ctx context.Context, handle uint32) (*seekInHandle, int32) {
+	switch f := s.file(ctx, handle).(type) {
+	case *seekInHandle:
+		return f, 0
+	case *inHandle:
+		return nil, errnoSpipe
+	default:
+		return nil, errnoBadf
+	}
+}
+
+// list writes the names of the entries of the PluginFS directory named by
+// the dirLen bytes at dir into buf, one per line, and returns their total
+// length or a negative errno. Nothing is written if the names don't fit in
+// bufLen bytes, so the plugin can retry with a buffer of the returned size.
+// It works under either transport, as a simpler alternative to WASI
+// fd_readdir.
+func (s *streamHost) list(ctx context.Context, m api.Module, dir, dirLen, buf, bufLen uint32) int32 {
+	if s.fs == nil {
+		return errnoNosys
+	}
+	b, ok := m.Memory().Read(dir, dirLen)
+	if !ok {
+		return errnoFault
+	}
+	entries, err := s.fs.ReadDir(string(b))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errnoNoent
+	case errors.Is(err, errNotDir):
+		return errnoNotdir
+	case err != nil:
+		return errnoInval
+	}
+
+	var names []byte
+	for _, e := range entries {
+		names = append(names, e.Name()...)
+		names = append(names, '\n')
+	}
+	if len(names) <= int(bufLen) && !m.Memory().Write(buf, names) {
+		return errnoFault
+	}
+	return int32(len(names))
+}
+
+func (s *streamHost) file(ctx context.Context, handle uint32) fs.File {
+	h, ok := ctx.Value(handlesKey{}).(*handles)
+	if !ok {
+		return nil
+	}
+	return h.get(handle)
+}
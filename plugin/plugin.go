@@ -4,51 +4,161 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"unsafe"
 )
 
 func main() {}
 
-//export do
-func _do(ptr, size uint32) {
+// abi_version_3 declares the host ABI this plugin is built for.
+//
+//go:wasmexport abi_version_3
+func abiVersion() {}
+
+// Statuses returned from do. Anything but statusOK comes with a message
+// from error_message.
+const (
+	statusOK uint32 = iota
+	statusOpenInput
+	statusOpenOutput
+	statusRead
+	statusWrite
+)
+
+// lastError describes the last failed do, for error_message.
+var lastError string
+
+//go:wasmexport do
+func _do(ptr, size uint32) uint32 {
 	name := ptrToString(uintptr(ptr), size)
-	do(name)
+	status, err := do(name)
+	if err != nil {
+		lastError = err.Error()
+	}
+	return status
+}
+
+// error_message returns the message for the last failed do, packed as the
+// pointer in the high 32 bits and the length in the low 32 bits. The host
+// gives the buffer back with my_free.
+//
+//go:wasmexport error_message
+func errorMessage() uint64 {
+	if lastError == "" {
+		return 0
+	}
+	ptr := my_malloc(uint32(len(lastError)))
+	copy(alivePointers[ptr], lastError)
+	return uint64(ptr)<<32 | uint64(len(lastError))
 }
 
-func do(id string) {
-	reader, err := os.OpenFile(
-		fmt.Sprintf("in/%v", id),
-		os.O_RDONLY,
-		0,
-	)
+func do(id string) (uint32, error) {
+	reader, err := openInput(id)
 	if err != nil {
-		fmt.Printf("error opening reader: %v\n", err)
-		return
+		return statusOpenInput, fmt.Errorf("error opening reader: %w", err)
 	}
 	defer reader.Close()
 
-	writer, err := os.OpenFile(
-		fmt.Sprintf("out/%v", id),
-		os.O_WRONLY,
-		0444,
-	)
+	writer, err := openOutput(id)
 	if err != nil {
-		fmt.Printf("error opening writer: %v\n", err)
-		return
+		return statusOpenOutput, fmt.Errorf("error opening writer: %w", err)
 	}
 	defer writer.Close()
 
 	data, err := io.ReadAll(reader)
 	if err != nil {
-		fmt.Printf("error reading: %v\n", err)
-		return
+		return statusRead, fmt.Errorf("error reading: %w", err)
 	}
 
 	_, err = writer.Write(data)
 	if err != nil {
-		fmt.Printf("error writing: %v\n", err)
-		return
+		return statusWrite, fmt.Errorf("error writing: %w", err)
+	}
+
+	if diag, err := openDiagnostics(id); err == nil {
+		fmt.Fprintf(diag, "copied %d bytes", len(data))
+		if contentType := readAttributes(id)["content-type"]; contentType != "" {
+			fmt.Fprintf(diag, " of %s", contentType)
+		}
+		fmt.Fprintln(diag)
+		diag.Close()
+	}
+	return statusOK, nil
+}
+
+// openInput opens the input of stream id through the stream host module,
+// or as a WASI file if the host doesn't provide streams that way.
+func openInput(id string) (io.ReadCloser, error) {
+	s, err := openHostStream(id, channelIn)
+	if err == errnoNosys {
+		return os.OpenFile(
+			fmt.Sprintf("in/%v", id),
+			os.O_RDONLY,
+			0,
+		)
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openOutput opens the output of stream id like openInput.
+func openOutput(id string) (io.WriteCloser, error) {
+	s, err := openHostStream(id, channelOut)
+	if err == errnoNosys {
+		return os.OpenFile(
+			fmt.Sprintf("out/%v", id),
+			os.O_WRONLY,
+			0444,
+		)
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openDiagnostics opens the err channel of stream id, which the host only
+// registers for the streams it wants diagnostics for.
+func openDiagnostics(id string) (io.WriteCloser, error) {
+	s, err := openHostChannel(id, "err")
+	if err == errnoNosys {
+		return os.OpenFile(
+			fmt.Sprintf("streams/%v/err", id),
+			os.O_WRONLY,
+			0444,
+		)
+	} else if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readAttributes returns the attributes the host registered stream id with,
+// read from its meta channel. It returns nil if there are none.
+func readAttributes(id string) map[string]string {
+	var meta io.ReadCloser
+	s, err := openHostChannel(id, "meta")
+	if err == errnoNosys {
+		meta, err = os.Open(fmt.Sprintf("streams/%v/meta", id))
+	} else if err == nil {
+		meta = s
+	}
+	if err != nil {
+		return nil
+	}
+	defer meta.Close()
+
+	b, err := io.ReadAll(meta)
+	if err != nil {
+		return nil
 	}
+	attrs := map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
 }
 
 // ptrToString returns a string from WebAssembly compatible numeric types
@@ -57,13 +167,25 @@ func ptrToString(ptr uintptr, size uint32) string {
 	return string(alivePointers[ptr])
 }
 
+// alivePointers keeps buffers handed to the host reachable until the host
+// gives them back with my_free.
 var alivePointers = map[uintptr][]byte{}
 
-//export my_malloc
+//go:wasmexport my_malloc
 func my_malloc(size uint32) uintptr {
+	if size == 0 {
+		// An empty buffer has no first byte to point at, and my_free of 0
+		// does nothing.
+		return 0
+	}
 	buf := make([]byte, size)
 	ptr := &buf[0]
 	unsafePtr := uintptr(unsafe.Pointer(ptr))
 	alivePointers[unsafePtr] = buf
 	return unsafePtr
 }
+
+//go:wasmexport my_free
+func my_free(ptr uintptr) {
+	delete(alivePointers, ptr)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unsafe"
+)
+
+// Channels of a stream passed to stream.open. Others are opened by name.
+const (
+	channelIn uint32 = iota
+	channelOut
+)
+
+// errno is a negative result from the stream host module.
+type errno int32
+
+const (
+	errnoNosys errno = -52
+)
+
+func (e errno) Error() string {
+	return fmt.Sprintf("stream errno %d", -e)
+}
+
+// hostStream is a stream channel opened through the stream host module.
+type hostStream struct {
+	handle uint32
+}
+
+// openHostStream opens a channel of stream id. It returns errnoNosys when
+// the host passes streams as files instead.
+func openHostStream(id string, channel uint32) (*hostStream, error) {
+	b := []byte(id)
+	h := streamOpen(unsafe.Pointer(&b[0]), uint32(len(b)), channel)
+	if h < 0 {
+		return nil, errno(h)
+	}
+	return &hostStream{handle: uint32(h)}, nil
+}
+
+// openHostChannel opens the named channel of stream id like
+// openHostStream.
+func openHostChannel(id, name string) (*hostStream, error) {
+	b, n := []byte(id), []byte(name)
+	h := streamOpenChannel(unsafe.Pointer(&b[0]), uint32(len(b)), unsafe.Pointer(&n[0]), uint32(len(n)))
+	if h < 0 {
+		return nil, errno(h)
+	}
+	return &hostStream{handle: uint32(h)}, nil
+}
+
+// listDir returns the names of the entries of a host directory, such as in
+// for the streams waiting to be read or streams/<id> for the channels of a
+// stream. It goes through the stream host module, as WASI fd_readdir isn't
+// available.
+func listDir(dir string) ([]string, error) {
+	d := []byte(dir)
+	buf := make([]byte, 256)
+	for {
+		n := streamList(unsafe.Pointer(&d[0]), uint32(len(d)), unsafe.Pointer(&buf[0]), uint32(len(buf)))
+		if n < 0 {
+			return nil, errno(n)
+		}
+		if int(n) > len(buf) {
+			buf = make([]byte, n)
+			continue
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		return strings.Split(string(buf[:n-1]), "\n"), nil
+	}
+}
+
+// Read implements io.Reader
+func (s *hostStream) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := streamRead(s.handle, unsafe.Pointer(&p[0]), uint32(len(p)))
+	if n < 0 {
+		return 0, errno(n)
+	} else if n == 0 {
+		return 0, io.EOF
+	}
+	return int(n), nil
+}
+
+// ReadAt implements io.ReaderAt for a seekable input.
+func (s *hostStream) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		c := streamReadAt(s.handle, unsafe.Pointer(&p[n]), uint32(len(p)-n), uint64(off)+uint64(n))
+		if c < 0 {
+			return n, errno(c)
+		} else if c == 0 {
+			return n, io.EOF
+		}
+		n += int(c)
+	}
+	return n, nil
+}
+
+// Seek implements io.Seeker for a seekable input.
+func (s *hostStream) Seek(offset int64, whence int) (int64, error) {
+	n := streamSeek(s.handle, offset, uint32(whence))
+	if n < 0 {
+		return 0, errno(n)
+	}
+	return n, nil
+}
+
+// Write implements io.Writer
+func (s *hostStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := streamWrite(s.handle, unsafe.Pointer(&p[0]), uint32(len(p)))
+	if n < 0 {
+		return 0, errno(n)
+	}
+	return int(n), nil
+}
+
+// Close implements io.Closer
+func (s *hostStream) Close() error {
+	if n := streamClose(s.handle); n < 0 {
+		return errno(n)
+	}
+	return nil
+}
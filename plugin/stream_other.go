@@ -0,0 +1,40 @@
+//go:build !wasm
+
+package main
+
+import "unsafe"
+
+// Outside of wasm there is no stream host module, so streams are always
+// opened as files.
+
+func streamOpen(id unsafe.Pointer, idLen, channel uint32) int32 {
+	return int32(errnoNosys)
+}
+
+func streamOpenChannel(id unsafe.Pointer, idLen uint32, name unsafe.Pointer, nameLen uint32) int32 {
+	return int32(errnoNosys)
+}
+
+func streamRead(handle uint32, buf unsafe.Pointer, bufLen uint32) int32 {
+	return int32(errnoNosys)
+}
+
+func streamReadAt(handle uint32, buf unsafe.Pointer, bufLen uint32, offset uint64) int32 {
+	return int32(errnoNosys)
+}
+
+func streamSeek(handle uint32, offset int64, whence uint32) int64 {
+	return int64(errnoNosys)
+}
+
+func streamWrite(handle uint32, buf unsafe.Pointer, bufLen uint32) int32 {
+	return int32(errnoNosys)
+}
+
+func streamClose(handle uint32) int32 {
+	return int32(errnoNosys)
+}
+
+func streamList(dir unsafe.Pointer, dirLen uint32, buf unsafe.Pointer, bufLen uint32) int32 {
+	return int32(errnoNosys)
+}
@@ -0,0 +1,31 @@
+//go:build wasm
+
+package main
+
+import "unsafe"
+
+// Imports from the stream host module.
+
+//go:wasmimport stream open
+func streamOpen(id unsafe.Pointer, idLen, channel uint32) int32
+
+//go:wasmimport stream open_channel
+func streamOpenChannel(id unsafe.Pointer, idLen uint32, name unsafe.Pointer, nameLen uint32) int32
+
+//go:wasmimport stream read
+func streamRead(handle uint32, buf unsafe.Pointer, bufLen uint32) int32
+
+//go:wasmimport stream read_at
+func streamReadAt(handle uint32, buf unsafe.Pointer, bufLen uint32, offset uint64) int32
+
+//go:wasmimport stream seek
+func streamSeek(handle uint32, offset int64, whence uint32) int64
+
+//go:wasmimport stream write
+func streamWrite(handle uint32, buf unsafe.Pointer, bufLen uint32) int32
+
+//go:wasmimport stream close
+func streamClose(handle uint32) int32
+
+//go:wasmimport stream list
+func streamList(dir unsafe.Pointer, dirLen uint32, buf unsafe.Pointer, bufLen uint32) int32